@@ -20,6 +20,8 @@ package async
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	keycloak "github.com/nmasse-itix/keycloak-client"
 	kcimport "github.com/nmasse-itix/keycloak-realm-import"
@@ -33,6 +35,8 @@ type KeycloakUserCreationRequest struct {
 type KeycloakClientCreationRequest struct {
 	Realm  string
 	Client keycloak.ClientRepresentation
+	// Roles created once the client exists
+	Roles []keycloak.RoleRepresentation
 }
 
 type KeycloakType int
@@ -64,6 +68,7 @@ type KeycloakResult struct {
 	Error        error
 	Retries      int
 	Worker       string
+	Duration     time.Duration
 }
 
 func NewKeycloakResult(worker string, t KeycloakType, realm *string, name *string, err error, retries int) KeycloakResult {
@@ -128,21 +133,17 @@ type Dispatcher struct {
 	clients      chan KeycloakClientCreationRequest
 	users        chan KeycloakUserCreationRequest
 	Results      chan KeycloakResult
-	tokenRenewer TokenRenewer
-	expiredToken chan struct{}
-	newToken     chan string
+	Metrics      *Metrics
+	tokenRenewer *TokenRenewer
+	// Clients (and their roles) not yet created
+	clientsPending *sync.WaitGroup
 }
 
 func NewDispatcher(workers int, config keycloak.Config, credentials kcimport.KeycloakCredentials) (Dispatcher, error) {
 	var dispatcher Dispatcher
 	var err error
 
-	dispatcher.tokenRenewer, err = NewTokenRenewer(config)
-	if err != nil {
-		return Dispatcher{}, err
-	}
-	dispatcher.tokenRenewer.Importer.Credentials = credentials
-	err = dispatcher.tokenRenewer.Importer.Login()
+	dispatcher.tokenRenewer, err = NewTokenRenewer(config, credentials)
 	if err != nil {
 		return Dispatcher{}, err
 	}
@@ -151,23 +152,20 @@ func NewDispatcher(workers int, config keycloak.Config, credentials kcimport.Key
 	if err != nil {
 		return Dispatcher{}, err
 	}
-	dispatcher.Importer.Token = dispatcher.tokenRenewer.Importer.Token
-	dispatcher.expiredToken = dispatcher.tokenRenewer.expiredToken
-	dispatcher.newToken = make(chan string, 1)
 	dispatcher.clients = make(chan KeycloakClientCreationRequest)
 	dispatcher.users = make(chan KeycloakUserCreationRequest)
 	dispatcher.Results = make(chan KeycloakResult)
+	dispatcher.Metrics = NewMetrics()
+	dispatcher.clientsPending = &sync.WaitGroup{}
 
 	dispatcher.Workers = make([]Worker, workers)
 	for i := 0; i < workers; i++ {
-		dispatcher.Workers[i] = NewWorker(fmt.Sprintf("worker-%03d", i), dispatcher.clients, dispatcher.users, dispatcher.Results, dispatcher.tokenRenewer.expiredToken)
+		dispatcher.Workers[i] = NewWorker(fmt.Sprintf("worker-%03d", i), dispatcher.clients, dispatcher.users, dispatcher.Results, dispatcher.tokenRenewer, dispatcher.Metrics, dispatcher.clientsPending)
 
 		importer, err := kcimport.NewKeycloakImporter(config)
 		if err != nil {
 			return Dispatcher{}, err
 		}
-		importer.Token = dispatcher.tokenRenewer.Importer.Token
-
 		dispatcher.Workers[i].Importer = importer
 	}
 
@@ -175,9 +173,12 @@ func NewDispatcher(workers int, config keycloak.Config, credentials kcimport.Key
 }
 
 func (dispatcher *Dispatcher) ApplyRealm(realm keycloak.RealmRepresentation) {
+	dispatcher.Metrics.requestStarted()
+	start := time.Now()
 	var err error
 	var retries int
 	for retries = 0; retries < 3; retries++ {
+		dispatcher.Importer.Token = dispatcher.tokenRenewer.Token()
 		err = dispatcher.Importer.ApplyRealm(realm)
 		if err == nil {
 			break
@@ -185,39 +186,46 @@ func (dispatcher *Dispatcher) ApplyRealm(realm keycloak.RealmRepresentation) {
 
 		if e, ok := err.(*kcimport.ImportError); ok {
 			if e.StatusCode == 401 {
-				dispatcher.expiredToken <- struct{}{}
-				select {
-				case newToken := <-dispatcher.newToken:
-					dispatcher.Importer.Token = newToken
-					continue
-				}
+				dispatcher.tokenRenewer.TokenExpired(dispatcher.Importer.Token)
 			}
 		}
 	}
 
-	dispatcher.Results <- NewKeycloakResult("dispatcher", KeycloakRealm, realm.ID, nil, err, 0)
+	dispatcher.Metrics.requestFinished()
+	realmName, _ := kcimport.RealmName(realm)
+	result := NewKeycloakResult("dispatcher", KeycloakRealm, &realmName, nil, err, 0)
+	result.Duration = time.Since(start)
+	dispatcher.Results <- result
 }
 
-func (dispatcher *Dispatcher) NewToken(token string) {
-	dispatcher.newToken <- token
-}
-
-func (dispatcher *Dispatcher) consumeNewToken() {
-	select {
-	case newToken := <-dispatcher.newToken:
-		dispatcher.Importer.Token = newToken
-	default:
+// ApplyClients sends the clients of a realm to the workers, with their roles
+// (by clientId). The clients count in the queue depth until a worker picks
+// them up.
+func (dispatcher *Dispatcher) ApplyClients(realmName string, clients []keycloak.ClientRepresentation, roles map[string][]keycloak.RoleRepresentation) {
+	dispatcher.Metrics.enqueued(len(clients))
+	for _, client := range clients {
+		var clientRoles []keycloak.RoleRepresentation
+		if client.ClientID != nil {
+			clientRoles = roles[*client.ClientID]
+		}
+		dispatcher.clientsPending.Add(1)
+		dispatcher.clients <- KeycloakClientCreationRequest{realmName, client, clientRoles}
 	}
 }
 
-func (dispatcher *Dispatcher) ApplyClient(realmName string, client keycloak.ClientRepresentation) {
-	dispatcher.consumeNewToken()
-	dispatcher.clients <- KeycloakClientCreationRequest{realmName, client}
+// WaitClients blocks until the clients submitted so far (and their roles)
+// have been created, so that users can be granted client roles.
+func (dispatcher *Dispatcher) WaitClients() {
+	dispatcher.clientsPending.Wait()
 }
 
-func (dispatcher *Dispatcher) ApplyUser(realmName string, user keycloak.UserRepresentation) {
-	dispatcher.consumeNewToken()
-	dispatcher.users <- KeycloakUserCreationRequest{realmName, user}
+// ApplyUsers sends users to the workers. The users count in the queue depth
+// until a worker picks them up.
+func (dispatcher *Dispatcher) ApplyUsers(realmName string, users []keycloak.UserRepresentation) {
+	dispatcher.Metrics.enqueued(len(users))
+	for _, user := range users {
+		dispatcher.users <- KeycloakUserCreationRequest{realmName, user}
+	}
 }
 
 func (dispatcher *Dispatcher) Stop() {
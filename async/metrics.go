@@ -0,0 +1,200 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package async
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	kcimport "github.com/nmasse-itix/keycloak-realm-import"
+)
+
+// Upper bounds (in seconds) of the request duration histogram buckets
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Metrics holds the counters and histograms of an import, exposed in the
+// Prometheus text format by ServeHTTP.
+type Metrics struct {
+	lock          sync.Mutex
+	processed     map[string]uint64
+	errors        map[string]uint64
+	retries       map[KeycloakType]uint64
+	durations     map[KeycloakType]*histogram
+	inFlight      int64
+	queueDepth    int64
+	tokenRenewals uint64
+	tokenFailures uint64
+}
+
+func NewMetrics() *Metrics {
+	var metrics Metrics
+	metrics.processed = make(map[string]uint64)
+	metrics.errors = make(map[string]uint64)
+	metrics.retries = make(map[KeycloakType]uint64)
+	metrics.durations = make(map[KeycloakType]*histogram)
+	return &metrics
+}
+
+// ObserveResult updates the counters from a result read on Dispatcher.Results.
+func (m *Metrics) ObserveResult(result KeycloakResult) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := fmt.Sprintf("type=%q,result=%q", result.ResourceType, ResultString(result.Success))
+	m.processed[key]++
+	m.retries[result.ResourceType] += uint64(result.Retries)
+
+	if !result.Success {
+		code := "none"
+		if e, ok := result.Error.(*kcimport.ImportError); ok && e.StatusCode != 0 {
+			code = strconv.Itoa(e.StatusCode)
+		}
+		m.errors[fmt.Sprintf("type=%q,code=%q", result.ResourceType, code)]++
+	}
+
+	h, ok := m.durations[result.ResourceType]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.durations[result.ResourceType] = h
+	}
+	seconds := result.Duration.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (m *Metrics) requestStarted() {
+	m.lock.Lock()
+	m.inFlight++
+	m.lock.Unlock()
+}
+
+func (m *Metrics) requestFinished() {
+	m.lock.Lock()
+	m.inFlight--
+	m.lock.Unlock()
+}
+
+func (m *Metrics) enqueued(count int) {
+	m.lock.Lock()
+	m.queueDepth += int64(count)
+	m.lock.Unlock()
+}
+
+func (m *Metrics) dequeued() {
+	m.lock.Lock()
+	m.queueDepth--
+	m.lock.Unlock()
+}
+
+func (m *Metrics) tokenRenewed(err error) {
+	m.lock.Lock()
+	if err != nil {
+		m.tokenFailures++
+	} else {
+		m.tokenRenewals++
+	}
+	m.lock.Unlock()
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.Export(w)
+}
+
+// Export writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) Export(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	writeHeader(w, "kci_objects_processed_total", "counter", "Number of Keycloak objects processed, by type and result.")
+	writeLabeledCounters(w, "kci_objects_processed_total", m.processed)
+
+	writeHeader(w, "kci_errors_total", "counter", "Number of failed Keycloak objects, by type and HTTP status code.")
+	writeLabeledCounters(w, "kci_errors_total", m.errors)
+
+	writeHeader(w, "kci_retries_total", "counter", "Number of retried requests, by type.")
+	for _, t := range sortedTypes(m.retries) {
+		fmt.Fprintf(w, "kci_retries_total{type=%q} %d\n", t, m.retries[t])
+	}
+
+	writeHeader(w, "kci_requests_in_flight", "gauge", "Number of requests currently sent to Keycloak.")
+	fmt.Fprintf(w, "kci_requests_in_flight %d\n", m.inFlight)
+
+	writeHeader(w, "kci_queue_depth", "gauge", "Number of decoded objects (users and clients) waiting for a worker.")
+	fmt.Fprintf(w, "kci_queue_depth %d\n", m.queueDepth)
+
+	writeHeader(w, "kci_token_renewals_total", "counter", "Number of OIDC token renewals, by result.")
+	fmt.Fprintf(w, "kci_token_renewals_total{result=%q} %d\n", ResultString(true), m.tokenRenewals)
+	fmt.Fprintf(w, "kci_token_renewals_total{result=%q} %d\n", ResultString(false), m.tokenFailures)
+
+	writeHeader(w, "kci_request_duration_seconds", "histogram", "Time spent importing an object, retries included, by type.")
+	types := make(map[KeycloakType]uint64, len(m.durations))
+	for t := range m.durations {
+		types[t] = 0
+	}
+	for _, t := range sortedTypes(types) {
+		h := m.durations[t]
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(w, "kci_request_duration_seconds_bucket{type=%q,le=%q} %d\n", t, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "kci_request_duration_seconds_bucket{type=%q,le=\"+Inf\"} %d\n", t, h.count)
+		fmt.Fprintf(w, "kci_request_duration_seconds_sum{type=%q} %g\n", t, h.sum)
+		fmt.Fprintf(w, "kci_request_duration_seconds_count{type=%q} %d\n", t, h.count)
+	}
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeLabeledCounters(w io.Writer, name string, counters map[string]uint64) {
+	labels := make([]string, 0, len(counters))
+	for l := range counters {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, l, counters[l])
+	}
+}
+
+func sortedTypes(m map[KeycloakType]uint64) []KeycloakType {
+	types := make([]KeycloakType, 0, len(m))
+	for t := range m {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
@@ -20,59 +20,155 @@ package async
 
 import (
 	"fmt"
+	"math"
+	"sync/atomic"
 	"time"
 
 	keycloak "github.com/nmasse-itix/keycloak-client"
 	kcimport "github.com/nmasse-itix/keycloak-realm-import"
 )
 
+// Tokens are renewed when a fifth of their lifespan remains, but no sooner
+// than 30 seconds before they expire.
+const maxRenewalMargin = 30 * time.Second
+
+// Delay before trying again when a token renewal fails
+const renewalRetryDelay = 5 * time.Second
+
+type tokenRenewalRequest struct {
+	staleToken string
+	done       chan struct{}
+}
+
 func (tr *TokenRenewer) RenewToken(dispatcher *Dispatcher) {
+	timer := time.NewTimer(tr.nextRenewal())
+	defer timer.Stop()
+
+	// Workers waiting for the next attempt, after a failed renewal
+	var pending []chan struct{}
+	renew := func() {
+		timer.Reset(tr.renew(dispatcher))
+		for _, done := range pending {
+			close(done)
+		}
+		pending = nil
+	}
+
 	for {
 		select {
 		case <-tr.quit:
 			return
-		case <-tr.expiredToken:
-			if time.Now().Sub(tr.LastTokenRenew) < 5*time.Second {
+		case <-timer.C:
+			renew()
+		case request := <-tr.expiredToken:
+			// Another worker may already have triggered the renewal
+			if request.staleToken != tr.Token() {
+				close(request.done)
 				continue
 			}
 
-			err := tr.Importer.Login()
-			if err != nil {
-				fmt.Printf("dispatcher: Cannot renew OIDC token: %s\n", err)
+			// After a failure, wait for the next attempt (already scheduled)
+			// rather than hammering the token endpoint
+			if time.Since(tr.lastRenewalFailure) < renewalRetryDelay {
+				pending = append(pending, request.done)
 				continue
 			}
 
-			tr.LastTokenRenew = time.Now()
-			for i := 0; i < len(dispatcher.Workers); i++ {
-				dispatcher.Workers[i].NewToken(tr.Importer.Token)
+			if !timer.Stop() {
+				<-timer.C
 			}
-			dispatcher.NewToken(tr.Importer.Token)
+			pending = append(pending, request.done)
+			renew()
 		}
 	}
 }
 
+// renew refreshes the OIDC token, publishes it to the workers and returns
+// the delay until the next renewal.
+func (tr *TokenRenewer) renew(dispatcher *Dispatcher) time.Duration {
+	err := tr.Importer.RefreshToken()
+	dispatcher.Metrics.tokenRenewed(err)
+	if err != nil {
+		fmt.Printf("dispatcher: Cannot renew OIDC token: %s\n", err)
+		tr.lastRenewalFailure = time.Now()
+		return renewalRetryDelay
+	}
+
+	tr.LastTokenRenew = time.Now()
+	tr.lastRenewalFailure = time.Time{}
+	tr.token.Store(tr.Importer.Token)
+
+	return tr.nextRenewal()
+}
+
+func (tr *TokenRenewer) nextRenewal() time.Duration {
+	token := tr.Importer.OIDCToken
+	lifespan := token.Lifespan()
+	if lifespan <= 0 {
+		// The token endpoint did not tell when the token expires, so rely
+		// on the workers to report expired tokens.
+		return time.Duration(math.MaxInt64)
+	}
+
+	margin := lifespan / 5
+	if margin > maxRenewalMargin {
+		margin = maxRenewalMargin
+	}
+
+	delay := token.ExpiresAt.Add(-margin).Sub(time.Now())
+	if delay < 0 {
+		delay = 0
+	}
+
+	return delay
+}
+
+// Token returns the current access token. It is safe for concurrent use.
+func (tr *TokenRenewer) Token() string {
+	return tr.token.Load().(string)
+}
+
+// TokenExpired is called when Keycloak rejected staleToken. It blocks until
+// the token has been renewed and returns the new one.
+func (tr *TokenRenewer) TokenExpired(staleToken string) string {
+	request := tokenRenewalRequest{staleToken: staleToken, done: make(chan struct{})}
+	tr.expiredToken <- request
+	<-request.done
+	return tr.Token()
+}
+
 func (tr *TokenRenewer) Stop() {
 	tr.quit <- struct{}{}
 }
 
 type TokenRenewer struct {
 	quit           chan struct{}
-	expiredToken   chan struct{}
+	expiredToken   chan tokenRenewalRequest
+	token          atomic.Value
 	Importer       kcimport.KeycloakImporter
 	LastTokenRenew time.Time
+	// Time of the last failed renewal (zero after a success)
+	lastRenewalFailure time.Time
 }
 
-func NewTokenRenewer(config keycloak.Config) (TokenRenewer, error) {
+func NewTokenRenewer(config keycloak.Config, credentials kcimport.KeycloakCredentials) (*TokenRenewer, error) {
 	var tokenRenewer TokenRenewer
-	tokenRenewer.LastTokenRenew = time.Now()
-	tokenRenewer.expiredToken = make(chan struct{})
+	tokenRenewer.expiredToken = make(chan tokenRenewalRequest)
 	tokenRenewer.quit = make(chan struct{})
 
 	var err error
 	tokenRenewer.Importer, err = kcimport.NewKeycloakImporter(config)
 	if err != nil {
-		return TokenRenewer{}, err
+		return nil, err
 	}
 
-	return tokenRenewer, nil
+	tokenRenewer.Importer.Credentials = credentials
+	err = tokenRenewer.Importer.Login()
+	if err != nil {
+		return nil, err
+	}
+	tokenRenewer.LastTokenRenew = time.Now()
+	tokenRenewer.token.Store(tokenRenewer.Importer.Token)
+
+	return &tokenRenewer, nil
 }
@@ -0,0 +1,211 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package async
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	kcimport "github.com/nmasse-itix/keycloak-realm-import"
+)
+
+// ResultObserver is implemented by everything that consumes the results
+// read on Dispatcher.Results.
+type ResultObserver interface {
+	ObserveResult(result KeycloakResult)
+}
+
+// CSVReport writes one row per imported object as soon as its result is known.
+type CSVReport struct {
+	out *csv.Writer
+	err error
+}
+
+func NewCSVReport(out io.Writer) *CSVReport {
+	var report CSVReport
+	report.out = csv.NewWriter(out)
+	report.err = report.out.Write([]string{"realm", "type", "name", "result", "status_code", "message", "retries", "worker", "duration_ms"})
+	return &report
+}
+
+func (report *CSVReport) ObserveResult(result KeycloakResult) {
+	if report.err != nil {
+		return
+	}
+
+	statusCode, message := errorDetails(result.Error)
+	var code string
+	if statusCode != 0 {
+		code = strconv.Itoa(statusCode)
+	}
+
+	report.err = report.out.Write([]string{
+		result.Realm,
+		result.ResourceType.String(),
+		result.Name,
+		ResultString(result.Success),
+		code,
+		message,
+		strconv.Itoa(result.Retries),
+		result.Worker,
+		strconv.FormatInt(result.Duration.Milliseconds(), 10),
+	})
+}
+
+// Close flushes the pending rows and returns the first error encountered.
+func (report *CSVReport) Close() error {
+	report.out.Flush()
+	if report.err != nil {
+		return report.err
+	}
+	return report.out.Error()
+}
+
+// JUnitReport aggregates results per realm and renders them as a JUnit XML
+// report: one testcase per realm, one failure per object that could not be
+// imported.
+type JUnitReport struct {
+	realms []string
+	cases  map[string]*junitTestCase
+	start  time.Time
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string         `xml:"name,attr"`
+	ClassName string         `xml:"classname,attr"`
+	Time      string         `xml:"time,attr"`
+	Failures  []junitFailure `xml:"failure"`
+	SystemOut string         `xml:"system-out,omitempty"`
+	objects   int
+	duration  time.Duration
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Content string `xml:",chardata"`
+}
+
+func NewJUnitReport() *JUnitReport {
+	var report JUnitReport
+	report.cases = make(map[string]*junitTestCase)
+	report.start = time.Now()
+	return &report
+}
+
+func (report *JUnitReport) ObserveResult(result KeycloakResult) {
+	testCase, ok := report.cases[result.Realm]
+	if !ok {
+		testCase = &junitTestCase{Name: result.Realm, ClassName: "realm"}
+		report.cases[result.Realm] = testCase
+		report.realms = append(report.realms, result.Realm)
+	}
+
+	testCase.objects++
+	testCase.duration += result.Duration
+	if !result.Success {
+		statusCode, message := errorDetails(result.Error)
+		testCase.Failures = append(testCase.Failures, junitFailure{
+			Message: fmt.Sprintf("%d: %s", statusCode, message),
+			Type:    strconv.Itoa(statusCode),
+			Content: fmt.Sprintf("%s (worker = %s, retries = %d)", *result.ObjectName(), result.Worker, result.Retries),
+		})
+	}
+}
+
+// Write renders the JUnit XML report.
+func (report *JUnitReport) Write(out io.Writer) error {
+	suite := junitTestSuite{
+		Name:      "kci import",
+		Time:      formatSeconds(time.Now().Sub(report.start)),
+		Timestamp: report.start.Format("2006-01-02T15:04:05"),
+	}
+
+	for _, realm := range report.realms {
+		testCase := *report.cases[realm]
+		testCase.Time = formatSeconds(testCase.duration)
+		testCase.SystemOut = fmt.Sprintf("%d objects processed, %d errors", testCase.objects, len(testCase.Failures))
+		suite.Tests++
+		if len(testCase.Failures) > 0 {
+			suite.Failures++
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+
+	suites := junitTestSuites{
+		Name:     suite.Name,
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Time:     suite.Time,
+		Suites:   []junitTestSuite{suite},
+	}
+
+	_, err := io.WriteString(out, xml.Header)
+	if err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(out)
+	encoder.Indent("", "  ")
+	err = encoder.Encode(suites)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(out, "\n")
+	return err
+}
+
+func errorDetails(err error) (int, string) {
+	if err == nil {
+		return 0, ""
+	}
+
+	if e, ok := err.(*kcimport.ImportError); ok {
+		return e.StatusCode, e.Message
+	}
+
+	return 0, err.Error()
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
@@ -19,6 +19,9 @@
 package async
 
 import (
+	"sync"
+	"time"
+
 	kcimport "github.com/nmasse-itix/keycloak-realm-import"
 )
 
@@ -28,81 +31,89 @@ type Worker struct {
 	quit         chan struct{}
 	results      chan KeycloakResult
 	Importer     kcimport.KeycloakImporter
-	newToken     chan string
 	Identity     string
-	expiredToken chan struct{}
+	tokenRenewer *TokenRenewer
+	metrics      *Metrics
+	// Clients (and their roles) not yet created
+	clientsPending *sync.WaitGroup
 }
 
-func NewWorker(identity string, clients chan KeycloakClientCreationRequest, users chan KeycloakUserCreationRequest, results chan KeycloakResult, expiredToken chan struct{}) Worker {
+func NewWorker(identity string, clients chan KeycloakClientCreationRequest, users chan KeycloakUserCreationRequest, results chan KeycloakResult, tokenRenewer *TokenRenewer, metrics *Metrics, clientsPending *sync.WaitGroup) Worker {
 	var worker Worker
 	worker.clients = clients
 	worker.quit = make(chan struct{})
 	worker.results = results
 	worker.users = users
-	worker.newToken = make(chan string, 1)
 	worker.Identity = identity
-	worker.expiredToken = expiredToken
+	worker.tokenRenewer = tokenRenewer
+	worker.metrics = metrics
+	worker.clientsPending = clientsPending
 	return worker
 }
 
 func (worker *Worker) Process() {
 	for {
 		select {
-		case newToken := <-worker.newToken:
-			worker.Importer.Token = newToken
 		case request := <-worker.users:
+			worker.metrics.dequeued()
+			worker.metrics.requestStarted()
+			start := time.Now()
 			var err error
 			var retries int
 			for retries = 0; retries < 3; retries++ {
+				worker.Importer.Token = worker.tokenRenewer.Token()
 				err = worker.Importer.ApplyUser(request.Realm, request.User)
+				if err == nil {
+					err = worker.Importer.ApplyUserRoles(request.Realm, request.User)
+				}
 				if err == nil {
 					break
 				}
 
 				if e, ok := err.(*kcimport.ImportError); ok {
 					if e.StatusCode == 401 {
-						worker.expiredToken <- struct{}{}
-						select {
-						case newToken := <-worker.newToken:
-							worker.Importer.Token = newToken
-							continue
-						}
+						worker.tokenRenewer.TokenExpired(worker.Importer.Token)
 					}
 				}
 			}
-			worker.results <- NewKeycloakResult(worker.Identity, KeycloakUser, &request.Realm, request.User.Username, err, retries)
+			worker.metrics.requestFinished()
+			result := NewKeycloakResult(worker.Identity, KeycloakUser, &request.Realm, request.User.Username, err, retries)
+			result.Duration = time.Since(start)
+			worker.results <- result
 		case request := <-worker.clients:
+			worker.metrics.dequeued()
+			worker.metrics.requestStarted()
+			start := time.Now()
 			var err error
 			var retries int
 			for retries = 0; retries < 3; retries++ {
+				worker.Importer.Token = worker.tokenRenewer.Token()
 				err = worker.Importer.ApplyClient(request.Realm, request.Client)
+				if err == nil && len(request.Roles) > 0 {
+					err = worker.Importer.ApplyClientRoles(request.Realm, *request.Client.ClientID, request.Roles)
+				}
 				if err == nil {
 					break
 				}
 
 				if e, ok := err.(*kcimport.ImportError); ok {
 					if e.StatusCode == 401 {
-						worker.expiredToken <- struct{}{}
-						select {
-						case newToken := <-worker.newToken:
-							worker.Importer.Token = newToken
-							continue
-						}
+						worker.tokenRenewer.TokenExpired(worker.Importer.Token)
 					}
 				}
 
 			}
-			worker.results <- NewKeycloakResult(worker.Identity, KeycloakClient, &request.Realm, request.Client.ClientID, err, retries)
+			worker.metrics.requestFinished()
+			result := NewKeycloakResult(worker.Identity, KeycloakClient, &request.Realm, request.Client.ClientID, err, retries)
+			result.Duration = time.Since(start)
+			worker.results <- result
+			worker.clientsPending.Done()
 		case <-worker.quit:
 			return
 		}
 	}
 }
 
-func (worker *Worker) NewToken(token string) {
-	worker.newToken <- token
-}
-
 func (worker *Worker) Stop() {
 	worker.quit <- struct{}{}
 }
@@ -19,7 +19,12 @@
 package cmd
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
+
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // configCmd represents the config command
@@ -35,3 +40,68 @@ var configCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(configCmd)
 }
+
+// loadConfigFile returns a configuration holding only the content of the
+// configuration file, so that defaults, flags and the active context are
+// not persisted when it is written back.
+func loadConfigFile() (*viper.Viper, error) {
+	config := newConfigFile(nil)
+	err := config.ReadInConfig()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func newConfigFile(settings map[string]interface{}) *viper.Viper {
+	config := viper.New()
+	config.SetConfigFile(configFilePath)
+	if filepath.Ext(configFilePath) == "" {
+		config.SetConfigType("yaml")
+	}
+
+	for k, v := range settings {
+		config.Set(k, v)
+	}
+
+	return config
+}
+
+func saveConfigFile(config *viper.Viper) error {
+	return config.WriteConfigAs(configFilePath)
+}
+
+// unsetConfigKey removes a (possibly nested) key from the configuration.
+// Viper cannot unset a key, so the configuration is rebuilt from scratch.
+func unsetConfigKey(config *viper.Viper, key string) (*viper.Viper, bool) {
+	settings := config.AllSettings()
+	path := strings.Split(strings.ToLower(key), ".")
+
+	parent := settings
+	for _, k := range path[:len(path)-1] {
+		child, ok := parent[k].(map[string]interface{})
+		if !ok {
+			return config, false
+		}
+		parent = child
+	}
+
+	last := path[len(path)-1]
+	if _, ok := parent[last]; !ok {
+		return config, false
+	}
+	delete(parent, last)
+
+	return newConfigFile(settings), true
+}
+
+// configFileKey returns the key under which a setting is stored in the
+// configuration file: settings go to the active context, if any.
+func configFileKey(key string) string {
+	definition, known := lookupConfigKey(key)
+	if name := activeContextName(); name != "" && (!known || definition.Context) {
+		return "contexts." + name + "." + key
+	}
+	return key
+}
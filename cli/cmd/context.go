@@ -0,0 +1,214 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// setContextCmd represents the set-context command
+var setContextCmd = &cobra.Command{
+	Use:   "set-context NAME",
+	Short: "Create or modify a connection context",
+	Long:  `Create or modify a connection context. Only the settings given as flags are modified.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name, err := checkContextName(args[0])
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		config, err := loadConfigFile()
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		prefix := "contexts." + name + "."
+		if !config.IsSet("contexts." + name) {
+			// Make sure the context exists even if no setting is provided
+			config.Set("contexts."+name, map[string]interface{}{})
+		}
+		// Inherited flags (--config, --context, etc.) are not context settings
+		cmd.LocalFlags().VisitAll(func(flag *pflag.Flag) {
+			if !flag.Changed {
+				return
+			}
+			key, known := lookupConfigKey(strings.ReplaceAll(flag.Name, "-", "_"))
+			if !known || !key.Context {
+				logger.Fatalf("'%s' is not a context setting\n", flag.Name)
+			}
+			value, err := key.Parse(flag.Value.String())
+			if err != nil {
+				logger.Fatal(err)
+			}
+			config.Set(prefix+key.Name, value)
+		})
+
+		err = saveConfigFile(config)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	},
+}
+
+// useContextCmd represents the use-context command
+var useContextCmd = &cobra.Command{
+	Use:   "use-context NAME",
+	Short: "Set the current connection context",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name, err := checkContextName(args[0])
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		config, err := loadConfigFile()
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		if !config.IsSet("contexts." + name) {
+			logger.Fatalf("No context named '%s'\n", name)
+		}
+
+		config.Set("current_context", name)
+		err = saveConfigFile(config)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	},
+}
+
+// getContextsCmd represents the get-contexts command
+var getContextsCmd = &cobra.Command{
+	Use:   "get-contexts",
+	Short: "List the connection contexts",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := loadConfigFile()
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		contexts := config.GetStringMap("contexts")
+		names := make([]string, 0, len(contexts))
+		for name := range contexts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		current := activeContextName()
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 3, ' ', 0)
+		fmt.Fprintln(w, "CURRENT\tNAME\tKEYCLOAK_URL\tREALM\tAUTH_METHOD")
+		for _, name := range names {
+			marker := ""
+			if name == current {
+				marker = "*"
+			}
+			prefix := "contexts." + name + "."
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", marker, name, config.GetString(prefix+"keycloak_url"), config.GetString(prefix+"realm"), config.GetString(prefix+"auth_method"))
+		}
+		w.Flush()
+	},
+}
+
+// deleteContextCmd represents the delete-context command
+var deleteContextCmd = &cobra.Command{
+	Use:   "delete-context NAME",
+	Short: "Delete a connection context",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name, err := checkContextName(args[0])
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		config, err := loadConfigFile()
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		config, found := unsetConfigKey(config, "contexts."+name)
+		if !found {
+			logger.Fatalf("No context named '%s'\n", name)
+		}
+		if config.GetString("current_context") == name {
+			config, _ = unsetConfigKey(config, "current_context")
+		}
+
+		err = saveConfigFile(config)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	},
+}
+
+// activeContextName returns the context selected with --context or, by
+// default, the current context.
+func activeContextName() string {
+	if contextName != "" {
+		return strings.ToLower(contextName)
+	}
+	return viper.GetString("current_context")
+}
+
+// applyContext merges the settings of the active context into the
+// configuration. Flags and environment variables keep their precedence.
+func applyContext() error {
+	name := activeContextName()
+	if name == "" {
+		return nil
+	}
+
+	if !viper.IsSet("contexts." + name) {
+		return fmt.Errorf("No context named '%s'", name)
+	}
+
+	return viper.MergeConfigMap(viper.GetStringMap("contexts." + name))
+}
+
+func checkContextName(name string) (string, error) {
+	if name == "" || strings.Contains(name, ".") {
+		return "", fmt.Errorf("Invalid context name '%s'", name)
+	}
+
+	// Viper keys are case insensitive
+	return strings.ToLower(name), nil
+}
+
+func init() {
+	configCmd.AddCommand(setContextCmd)
+	configCmd.AddCommand(useContextCmd)
+	configCmd.AddCommand(getContextsCmd)
+	configCmd.AddCommand(deleteContextCmd)
+
+	for _, key := range configKeys {
+		if key.Context {
+			setContextCmd.Flags().String(strings.ReplaceAll(key.Name, "_", "-"), "", key.Description)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// describeCmd represents the describe command
+var describeCmd = &cobra.Command{
+	Use:   "describe [KEY]",
+	Short: "Describe the configuration keys",
+	Long:  `List the known configuration keys with their type, default value and description, or describe a single key.`,
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 1 {
+			key, known := lookupConfigKey(args[0])
+			if !known {
+				logger.Fatalf("Unknown configuration key '%s'\n", args[0])
+			}
+
+			fmt.Printf("Key:         %s\n", key.Name)
+			fmt.Printf("Type:        %s\n", key.TypeName())
+			if key.Default != nil {
+				fmt.Printf("Default:     %v\n", key.Default)
+			}
+			fmt.Printf("Secret:      %v\n", key.Secret)
+			fmt.Printf("Context:     %v\n", key.Context)
+			fmt.Printf("Description: %s\n", key.Description)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 3, ' ', 0)
+		fmt.Fprintln(w, "KEY\tTYPE\tDEFAULT\tDESCRIPTION")
+		for _, key := range configKeys {
+			var defaultValue string
+			if key.Default != nil {
+				defaultValue = fmt.Sprintf("%v", key.Default)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key.Name, key.TypeName(), defaultValue, key.Description)
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	configCmd.AddCommand(describeCmd)
+}
@@ -23,6 +23,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"runtime"
+	"sync"
 	"text/template"
 
 	kcimport "github.com/nmasse-itix/keycloak-realm-import"
@@ -30,7 +32,15 @@ import (
 )
 
 var realmCount, clientCount, userCount int
-var targetDir, customTemplateFile string
+var targetDir, customTemplateFile, specFile, layout, format string
+var usersPerFile int
+var passwordHashing kcimport.PasswordHashing
+var seed int64
+var groupTree kcimport.GroupTreeSpec
+var roles kcimport.RoleSpec
+var streaming bool
+var parallel int
+var compress bool
 
 // generateCmd represents the generate command
 var generateCmd = &cobra.Command{
@@ -38,6 +48,17 @@ var generateCmd = &cobra.Command{
 	Short: "Generate Keycloak realms",
 	Long:  `TODO`,
 	Run: func(cmd *cobra.Command, args []string) {
+		if layout != kcimport.SingleFileLayout && layout != kcimport.KeycloakDirLayout {
+			logger.Fatalf("Unknown layout '%s' (valid values are '%s' and '%s')\n", layout, kcimport.SingleFileLayout, kcimport.KeycloakDirLayout)
+		}
+
+		if format != kcimport.JSONFormat && format != kcimport.YAMLFormat {
+			logger.Fatalf("Unknown format '%s' (valid values are '%s' and '%s')\n", format, kcimport.JSONFormat, kcimport.YAMLFormat)
+		}
+		if format == kcimport.YAMLFormat && layout == kcimport.KeycloakDirLayout {
+			logger.Fatalf("The '%s' layout is only available with the '%s' format\n", kcimport.KeycloakDirLayout, kcimport.JSONFormat)
+		}
+
 		err := os.MkdirAll(targetDir, 0777)
 		if err != nil {
 			logger.Fatal(err)
@@ -52,22 +73,80 @@ var generateCmd = &cobra.Command{
 
 			content := string(b)
 			customTemplate, err = kcimport.GetRealmTemplate(content)
+			if err != nil {
+				logger.Fatal(err)
+			}
 		}
-		realms := kcimport.GenerateRealms(realmCount, clientCount, userCount)
 
-		for _, realm := range realms {
-			f, err := os.OpenFile(path.Join(targetDir, fmt.Sprintf("realm-%s.json", realm.ID)), os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0666)
+		spec := kcimport.UniformSpec(realmCount, clientCount, userCount)
+		spec.Groups[0].GroupTree = groupTree
+		spec.Groups[0].Roles = roles
+		if specFile != "" {
+			for _, flag := range []string{"realms", "clients", "users", "group-depth", "group-fanout", "group-membership", "realm-roles", "client-roles", "composite-roles", "composite-size", "user-realm-roles", "user-client-roles"} {
+				if cmd.Flags().Changed(flag) {
+					logger.Fatalf("--%s cannot be used with --spec\n", flag)
+				}
+			}
+
+			spec, err = kcimport.LoadGenerationSpec(specFile)
 			if err != nil {
 				logger.Fatal(err)
 			}
-			defer f.Close()
+		}
 
-			if customTemplate != nil {
-				err = kcimport.WriteRealmFileWithTemplate(realm, f, customTemplate)
-			} else {
-				err = kcimport.WriteRealmFile(realm, f)
+		if !cmd.Flags().Changed("seed") && spec.Seed != nil {
+			seed = *spec.Seed
+		} else if !cmd.Flags().Changed("seed") {
+			seed = kcimport.NewSeed()
+		}
+		logger.Printf("Generating realms with seed %d (use --seed %d to generate them again)\n", seed, seed)
+		generateRealms := kcimport.GenerateRealms
+		if streaming {
+			generateRealms = kcimport.GenerateStreamingRealms
+		}
+		realms, err := generateRealms(seed, spec)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		if passwordHashing.Algorithm != "" {
+			for i := range realms {
+				err := kcimport.HashPasswords(&realms[i], passwordHashing, runtime.NumCPU())
+				if err != nil {
+					logger.Fatal(err)
+				}
+			}
+		}
+
+		// Realms are rendered in parallel
+		if parallel < 1 {
+			parallel = 1
+		}
+		queue := make(chan kcimport.GeneratedRealm)
+		errs := make(chan error, len(realms))
+		var wg sync.WaitGroup
+		for i := 0; i < parallel; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for realm := range queue {
+					errs <- writeRealm(realm)
+				}
+			}()
+		}
+
+		for _, realm := range realms {
+			// The template of the realm group takes precedence over --template
+			if realm.Template == nil {
+				realm.Template = customTemplate
 			}
+			queue <- realm
+		}
+		close(queue)
+		wg.Wait()
+		close(errs)
 
+		for err := range errs {
 			if err != nil {
 				logger.Fatal(err)
 			}
@@ -75,6 +154,19 @@ var generateCmd = &cobra.Command{
 	},
 }
 
+// writeRealm writes a realm in the target directory, with the chosen layout
+func writeRealm(realm kcimport.GeneratedRealm) error {
+	if layout == kcimport.KeycloakDirLayout {
+		return kcimport.WriteRealmDir(realm, targetDir, usersPerFile, compress)
+	}
+
+	filename := path.Join(targetDir, fmt.Sprintf("realm-%s.%s", realm.ID, format))
+	if compress {
+		filename += kcimport.GzipExtension
+	}
+	return kcimport.WriteRealmFileAs(realm, filename, compress)
+}
+
 func init() {
 	rootCmd.AddCommand(generateCmd)
 	generateCmd.Flags().IntVar(&realmCount, "realms", 1, "number of realms to generate")
@@ -82,4 +174,23 @@ func init() {
 	generateCmd.Flags().IntVar(&userCount, "users", 10, "number of users to generate per realm")
 	generateCmd.Flags().StringVar(&targetDir, "target", ".", "target directory")
 	generateCmd.Flags().StringVar(&customTemplateFile, "template", "", "go template used to generate the realm")
+	generateCmd.Flags().StringVar(&layout, "layout", kcimport.SingleFileLayout, "layout of the generated files (single-file or keycloak-dir)")
+	generateCmd.Flags().StringVar(&format, "format", kcimport.JSONFormat, "format of the realms written by the template (json or yaml)")
+	generateCmd.Flags().IntVar(&usersPerFile, "users-per-file", kcimport.DefaultUsersPerFile, "number of users per file, with the keycloak-dir layout")
+	generateCmd.Flags().StringVar(&specFile, "spec", "", "YAML or JSON file describing the realms to generate")
+	generateCmd.Flags().StringVar(&passwordHashing.Algorithm, "hash-passwords", "", "pre-hash user passwords with this algorithm (pbkdf2-sha256 or pbkdf2-sha512)")
+	generateCmd.Flags().IntVar(&groupTree.Depth, "group-depth", 0, "number of levels of the group tree of each realm")
+	generateCmd.Flags().IntVar(&groupTree.Fanout, "group-fanout", 0, "number of sub-groups of each group")
+	generateCmd.Flags().Float64Var(&groupTree.Membership, "group-membership", 0, "share of the users being member of a group (between 0 and 1)")
+	generateCmd.Flags().IntVar(&roles.RealmRoles, "realm-roles", 0, "number of realm roles of each realm")
+	generateCmd.Flags().IntVar(&roles.ClientRoles, "client-roles", 0, "number of roles of each client")
+	generateCmd.Flags().IntVar(&roles.Composites, "composite-roles", 0, "number of composite roles, among the realm roles")
+	generateCmd.Flags().IntVar(&roles.CompositeSize, "composite-size", 0, "number of realm roles in each composite role")
+	generateCmd.Flags().IntVar(&roles.UserRealmRoles, "user-realm-roles", 0, "number of realm roles granted to each user")
+	generateCmd.Flags().IntVar(&roles.UserClientRoles, "user-client-roles", 0, "number of client roles granted to each user")
+	generateCmd.Flags().Int64Var(&seed, "seed", 0, "seed of the random values (random by default)")
+	generateCmd.Flags().BoolVar(&streaming, "stream", false, "generate users and clients while the realms are written, to use less memory")
+	generateCmd.Flags().BoolVar(&compress, "gzip", false, "gzip-compress the generated files (.json.gz)")
+	generateCmd.Flags().IntVar(&parallel, "parallel", runtime.NumCPU(), "number of realms written in parallel")
+	generateCmd.Flags().IntVar(&passwordHashing.Iterations, "hash-iterations", kcimport.DefaultHashIterations, "number of iterations used to pre-hash user passwords")
 }
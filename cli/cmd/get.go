@@ -38,7 +38,11 @@ var getCmd = &cobra.Command{
 			return
 		}
 
-		fmt.Println(viper.Get(args[0]))
+		if _, known := lookupConfigKey(args[0]); !known && !viper.IsSet(args[0]) {
+			logger.Fatalf("Unknown configuration key '%s'. Use 'kci config describe' to list the known keys.\n", args[0])
+		}
+
+		fmt.Println(maskSecret(args[0], viper.Get(args[0])))
 	},
 }
 
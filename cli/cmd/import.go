@@ -19,9 +19,9 @@
 package cmd
 
 import (
-	"encoding/json"
-	"fmt"
 	"io/ioutil"
+	"net/http"
+	"os"
 	"time"
 
 	keycloak "github.com/nmasse-itix/keycloak-client"
@@ -31,6 +31,11 @@ import (
 	"github.com/spf13/viper"
 )
 
+var metricsListen, junitReportFile, csvReportFile string
+var inputFilter kcimport.InputFilter
+var patchFiles []string
+var cloneOptions kcimport.CloneOptions
+
 // importCmd represents the import command
 var importCmd = &cobra.Command{
 	Use:   "import",
@@ -44,31 +49,61 @@ var importCmd = &cobra.Command{
 			return
 		}
 
-		var realm, login, password, keycloakURL string
-		realm = viper.GetString("realm")
-		login = viper.GetString("login")
-		password = viper.GetString("password")
-		keycloakURL = viper.GetString("keycloak_url")
-		missingConfig := false
+		err := cloneOptions.Validate()
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if cloneOptions.Count > 0 {
+			if !cmd.Flags().Changed("seed") {
+				cloneOptions.Seed = kcimport.NewSeed()
+			}
+			logger.Printf("Cloning realms with seed %d (use --seed %d to clone them again)\n", cloneOptions.Seed, cloneOptions.Seed)
+		}
 
-		if realm == "" {
-			logger.Println("Missing configuration key 'realm'")
-			missingConfig = true
+		// Realm files and secrets cannot both be read from stdin
+		for _, arg := range args {
+			if key := stdinSecret("password", "client_secret"); arg == kcimport.StdinInput && key != "" {
+				logger.Fatalf("Cannot import realm files from stdin ('%s') when %s_from is 'stdin'\n", kcimport.StdinInput, key)
+			}
+		}
+
+		var patches []kcimport.RealmPatch
+		for _, filename := range patchFiles {
+			patch, err := kcimport.LoadRealmPatch(filename)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			patches = append(patches, patch)
 		}
 
-		if login == "" {
-			logger.Println("Missing configuration key 'login'")
-			missingConfig = true
+		authMethod := viper.GetString("auth_method")
+		keycloakURL := viper.GetString("keycloak_url")
+		credentials := kcimport.KeycloakCredentials{
+			Realm:       viper.GetString("realm"),
+			AuthMethod:  authMethod,
+			Login:       viper.GetString("login"),
+			ClientID:    viper.GetString("client_id"),
+			ClientKeyID: viper.GetString("client_key_id"),
 		}
 
-		if password == "" {
-			logger.Println("Missing configuration key 'password'")
-			missingConfig = true
+		requiredConfig := []string{"realm", "keycloak_url"}
+		switch authMethod {
+		case kcimport.PasswordAuth:
+			requiredConfig = append(requiredConfig, "login", "password")
+		case kcimport.ClientSecretAuth:
+			requiredConfig = append(requiredConfig, "client_id", "client_secret")
+		case kcimport.ClientJWTAuth:
+			requiredConfig = append(requiredConfig, "client_id", "client_key")
+		default:
+			logger.Fatalf("Unknown authentication method '%s' (valid values are '%s', '%s' and '%s')\n", authMethod, kcimport.PasswordAuth, kcimport.ClientSecretAuth, kcimport.ClientJWTAuth)
 		}
 
-		if keycloakURL == "" {
-			logger.Println("Missing configuration key 'keycloak_url'")
-			missingConfig = true
+		missingConfig := false
+		for _, key := range requiredConfig {
+			if viper.GetString(key) == "" && viper.GetString(key+"_from") == "" {
+				logger.Printf("Missing configuration key '%s'\n", key)
+				missingConfig = true
+			}
 		}
 
 		if missingConfig {
@@ -77,38 +112,156 @@ var importCmd = &cobra.Command{
 			logger.Fatalln()
 		}
 
+		if authMethod == kcimport.PasswordAuth {
+			credentials.Password, err = resolveSecret("password")
+			if err != nil {
+				logger.Fatal(err)
+			}
+		}
+
+		// A client secret can also be used with the password grant
+		if authMethod != kcimport.ClientJWTAuth {
+			credentials.ClientSecret, err = resolveSecret("client_secret")
+			if err != nil {
+				logger.Fatal(err)
+			}
+		}
+
+		if authMethod == kcimport.ClientJWTAuth {
+			content, err := ioutil.ReadFile(viper.GetString("client_key"))
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			credentials.ClientKey, err = kcimport.ParseClientKey(content)
+			if err != nil {
+				logger.Fatal(err)
+			}
+		}
+
 		var config keycloak.Config
-		config.AddrAPI = keycloakURL
-		config.AddrTokenProvider = keycloakURL + "/realms/master"
 		config.Timeout = time.Duration(viper.GetInt64("http_timeout")) * time.Second
 
+		tlsConfig, err := kcimport.NewTLSConfig(kcimport.TLSOptions{
+			CABundle:           viper.GetString("tls_ca_bundle"),
+			ClientCert:         viper.GetString("tls_client_cert"),
+			ClientKey:          viper.GetString("tls_client_key"),
+			MinVersion:         viper.GetString("tls_min_version"),
+			InsecureSkipVerify: viper.GetBool("tls_insecure_skip_verify"),
+		})
+		if err != nil {
+			logger.Fatal(err)
+		}
+		kcimport.SetTLSConfig(tlsConfig)
+
+		baseURL, err := kcimport.ResolveBaseURL(keycloakURL, viper.GetString("context_path"), credentials.Realm, kcimport.NewHTTPClient(config.Timeout))
+		if err != nil {
+			logger.Fatal(err)
+		}
+		config.AddrAPI = baseURL
+		config.AddrTokenProvider = kcimport.RealmURL(baseURL, credentials.Realm)
+
 		workers := viper.GetInt("workers")
 		logger.Printf("Starting import with %d workers...\n", workers)
-		dispatcher, err := async.NewDispatcher(workers, config, kcimport.KeycloakCredentials{Realm: realm, Login: login, Password: password})
+		dispatcher, err := async.NewDispatcher(workers, config, credentials)
 		if err != nil {
 			logger.Fatal(err)
 		}
 
+		if metricsListen != "" {
+			go serveMetrics(metricsListen, dispatcher.Metrics)
+		}
+
+		observers := []async.ResultObserver{dispatcher.Metrics}
+
+		var csvReport *async.CSVReport
+		if csvReportFile != "" {
+			f, err := os.Create(csvReportFile)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			defer f.Close()
+			csvReport = async.NewCSVReport(f)
+			observers = append(observers, csvReport)
+		}
+
+		var junitReport *async.JUnitReport
+		if junitReportFile != "" {
+			junitReport = async.NewJUnitReport()
+			observers = append(observers, junitReport)
+		}
+
 		compileResults := make(chan struct{})
-		go processResults(&dispatcher, compileResults)
-		importRealms(&dispatcher, args)
+		go processResults(&dispatcher, observers, compileResults)
+		// The reports are written even when the import fails
+		importErr := importRealms(&dispatcher, args, patches)
 		compileResults <- struct{}{}
+		<-compileResults
+
+		if csvReport != nil {
+			err := csvReport.Close()
+			if err != nil {
+				logger.Fatal(err)
+			}
+		}
+
+		if junitReport != nil {
+			err := writeJUnitReport(junitReportFile, junitReport)
+			if err != nil {
+				logger.Fatal(err)
+			}
+		}
+
+		if importErr != nil {
+			logger.Fatal(importErr)
+		}
 	},
 }
 
-func importRealms(dispatcher *async.Dispatcher, files []string) {
+func writeJUnitReport(filename string, report *async.JUnitReport) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = report.Write(f)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func importRealms(dispatcher *async.Dispatcher, args []string, patches []kcimport.RealmPatch) error {
 	go dispatcher.Start()
 	defer dispatcher.Stop()
 
-	for _, file := range files {
-		err := processRealmFile(file, dispatcher)
-		if err != nil {
-			logger.Fatal(err)
-		}
+	inputs, err := kcimport.OpenInputs(args, inputFilter)
+	if err != nil {
+		return err
+	}
+	defer inputs.Close()
+
+	// The realm is created first, then its users are streamed in
+	return kcimport.WalkRealmFiles(inputs, func(input kcimport.RealmInput) error {
+		return processRealmFile(input, patches, dispatcher)
+	}, func(realm string, input kcimport.RealmInput) error {
+		return processUsersFile(input, realm, patches, dispatcher)
+	})
+}
+
+func serveMetrics(addr string, metrics *async.Metrics) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	logger.Printf("Exposing Prometheus metrics on %s/metrics\n", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		logger.Printf("Cannot expose Prometheus metrics: %s\n", err)
 	}
 }
 
-func processResults(dispatcher *async.Dispatcher, compileResults chan struct{}) {
+func processResults(dispatcher *async.Dispatcher, observers []async.ResultObserver, compileResults chan struct{}) {
 	var count, errors, retries, oldCount int
 	var empty string = ""
 	var lastObject *string = &empty
@@ -123,6 +276,9 @@ func processResults(dispatcher *async.Dispatcher, compileResults chan struct{})
 			oldCount = newCount
 			timer.Reset(time.Second)
 		case result := <-dispatcher.Results:
+			for _, observer := range observers {
+				observer.ObserveResult(result)
+			}
 			if result.Success {
 				count++
 				retries += result.Retries
@@ -134,53 +290,116 @@ func processResults(dispatcher *async.Dispatcher, compileResults chan struct{})
 		case <-compileResults:
 			logger.Printf("%s: IMPORT IS COMPLETE. %d objects processed, %d errors\n", time.Now().Format("15:04:05"), count, errors)
 			timer.Stop()
+			compileResults <- struct{}{}
 			return
 		}
 	}
 
 }
 
-func processRealmFile(filename string, dispatcher *async.Dispatcher) error {
-	realmData, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return err
+// processRealmFile imports a realm file, once patched, or its clones
+func processRealmFile(input kcimport.RealmInput, patches []kcimport.RealmPatch, dispatcher *async.Dispatcher) error {
+	if cloneOptions.Count > 0 {
+		return kcimport.CloneRealmFile(input, patches, cloneOptions, func(realm keycloak.RealmRepresentation) error {
+			return importRealm(realm, dispatcher)
+		})
 	}
 
 	var realm keycloak.RealmRepresentation
-	err = json.Unmarshal(realmData, &realm)
+	err := kcimport.DecodePatchedRealmFile(input, patches, &realm)
 	if err != nil {
 		return err
 	}
 
+	return importRealm(realm, dispatcher)
+}
+
+// importRealm creates the realm, then its users and clients
+func importRealm(realm keycloak.RealmRepresentation, dispatcher *async.Dispatcher) error {
 	clients := realm.Clients
 	users := realm.Users
 
 	realm.Clients = &[]keycloak.ClientRepresentation{}
 	realm.Users = &[]keycloak.UserRepresentation{}
 
-	if realm.ID == nil {
-		return fmt.Errorf("Missing realm ID in RealmRepresentation")
+	// Client roles can only be created once their client exists
+	var clientRoles map[string][]keycloak.RoleRepresentation
+	if realm.Roles != nil {
+		if realm.Roles.Client != nil {
+			clientRoles = *realm.Roles.Client
+		}
+		realm.Roles = &keycloak.RolesRepresentation{Realm: realm.Roles.Realm}
+	}
+
+	realmName, err := kcimport.RealmName(realm)
+	if err != nil {
+		return err
 	}
 
 	dispatcher.ApplyRealm(realm)
 
+	if clients != nil {
+		dispatcher.ApplyClients(realmName, *clients, clientRoles)
+	}
+
+	// Users are granted client roles, hence the clients have to exist first
+	dispatcher.WaitClients()
+
 	if users != nil {
-		for _, user := range *users {
-			dispatcher.ApplyUser(*realm.ID, user)
-		}
+		dispatcher.ApplyUsers(realmName, *users)
 	}
 
-	if clients != nil {
-		for _, client := range *clients {
-			dispatcher.ApplyClient(*realm.ID, client)
-		}
+	return nil
+}
+
+// processUsersFile imports a <realm>-users-<n>.json file of the layout of
+// "kc.sh export --dir"
+func processUsersFile(input kcimport.RealmInput, realmName string, patches []kcimport.RealmPatch, dispatcher *async.Dispatcher) error {
+	if cloneOptions.Count > 0 {
+		return kcimport.CloneUsersFile(input, realmName, patches, cloneOptions, func(usersFile kcimport.UsersFile) error {
+			return importUsers(usersFile, usersFile.Realm, dispatcher)
+		})
+	}
+
+	var usersFile kcimport.UsersFile
+	err := kcimport.DecodePatchedRealmFile(input, patches, &usersFile)
+	if err != nil {
+		return err
+	}
+
+	return importUsers(usersFile, realmName, dispatcher)
+}
+
+func importUsers(usersFile kcimport.UsersFile, realmName string, dispatcher *async.Dispatcher) error {
+	if usersFile.Realm != "" {
+		realmName = usersFile.Realm
 	}
 
+	dispatcher.ApplyUsers(realmName, usersFile.Users)
+
 	return nil
 }
 
 func init() {
 	rootCmd.AddCommand(importCmd)
-	viper.SetDefault("http_timeout", 30)
-	viper.SetDefault("workers", 5)
+	importCmd.Flags().StringVar(&metricsListen, "metrics", "", "address on which to expose Prometheus metrics (example: ':9100')")
+	importCmd.Flags().StringVar(&junitReportFile, "junit", "", "write a JUnit XML report of the import to this file")
+	importCmd.Flags().StringVar(&csvReportFile, "csv", "", "write a CSV report with one row per imported object to this file")
+	importCmd.Flags().StringArrayVar(&inputFilter.Includes, "include", nil, "glob pattern of the files to import from directories and archives (default \"*.json\", \"*.yaml\", \"*.yml\" and their .gz variants)")
+	importCmd.Flags().StringArrayVar(&inputFilter.Excludes, "exclude", nil, "glob pattern of the files to skip in directories and archives")
+	importCmd.Flags().StringArrayVar(&patchFiles, "patch", nil, "JSON Patch (RFC 6902) or JSON Merge Patch (RFC 7386) file to apply to each realm file, in JSON or YAML (can be repeated)")
+	importCmd.Flags().IntVar(&cloneOptions.Count, "clone", 0, "import each realm file as this number of distinct realms")
+	importCmd.Flags().StringVar(&cloneOptions.NameFormat, "realm-name-format", "", "format of the names of the cloned realms, given the index of the clone (default \"<realm>_%03d\")")
+	importCmd.Flags().BoolVar(&cloneOptions.RegenerateSecrets, "regenerate-secrets", false, "regenerate the client secrets of the cloned realms")
+	importCmd.Flags().Int64Var(&cloneOptions.Seed, "seed", 0, "seed of the IDs and secrets of the cloned realms (random by default)")
+	importCmd.Flags().String("tls-ca-bundle", "", "PEM file with additional certificate authorities to trust")
+	importCmd.Flags().String("tls-client-cert", "", "PEM file with the client certificate used for mutual TLS")
+	importCmd.Flags().String("tls-client-key", "", "PEM file with the client key used for mutual TLS")
+	importCmd.Flags().String("tls-min-version", "", "minimum TLS version (1.0, 1.1, 1.2 or 1.3)")
+	importCmd.Flags().Bool("tls-insecure-skip-verify", false, "do not verify the server certificate (insecure)")
+	viper.BindPFlag("tls_ca_bundle", importCmd.Flags().Lookup("tls-ca-bundle"))
+	viper.BindPFlag("tls_client_cert", importCmd.Flags().Lookup("tls-client-cert"))
+	viper.BindPFlag("tls_client_key", importCmd.Flags().Lookup("tls-client-key"))
+	viper.BindPFlag("tls_min_version", importCmd.Flags().Lookup("tls-min-version"))
+	viper.BindPFlag("tls_insecure_skip_verify", importCmd.Flags().Lookup("tls-insecure-skip-verify"))
 }
@@ -0,0 +1,171 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	kcimport "github.com/nmasse-itix/keycloak-realm-import"
+	"github.com/spf13/viper"
+)
+
+// Types of the configuration values
+const (
+	stringType = "string"
+	intType    = "int"
+	boolType   = "bool"
+	enumType   = "enum"
+)
+
+// configKey describes a configuration key known by kci
+type configKey struct {
+	Name        string
+	Type        string
+	Default     interface{}
+	Description string
+	// Allowed values of an enum
+	Values []string
+	// Additional validation of the value, after the type checks
+	Validate func(value string) error
+	// Secret values are masked when displayed
+	Secret bool
+	// Context settings can be stored in a connection context
+	Context bool
+}
+
+var configKeys = []configKey{
+	{Name: "keycloak_url", Type: stringType, Description: "URL of the Keycloak server", Validate: validateURL, Context: true},
+	{Name: "context_path", Type: stringType, Default: kcimport.AutoContextPath, Description: "Keycloak context path ('auto' to detect it, '/auth' for Keycloak 16 and earlier, '/' for none)", Context: true},
+	{Name: "realm", Type: stringType, Description: "realm of the admin user or client", Context: true},
+	{Name: "auth_method", Type: enumType, Default: kcimport.PasswordAuth, Description: "authentication method", Values: []string{kcimport.PasswordAuth, kcimport.ClientSecretAuth, kcimport.ClientJWTAuth}, Context: true},
+	{Name: "login", Type: stringType, Description: "admin login", Context: true},
+	{Name: "password", Type: stringType, Description: "admin password", Secret: true, Context: true},
+	{Name: "password_from", Type: stringType, Description: "source of the admin password (env:NAME, file:PATH, stdin or store:ENTRY)", Validate: validateSecretSource, Context: true},
+	{Name: "client_id", Type: stringType, Description: "admin client id", Context: true},
+	{Name: "client_secret", Type: stringType, Description: "admin client secret", Secret: true, Context: true},
+	{Name: "client_secret_from", Type: stringType, Description: "source of the admin client secret (env:NAME, file:PATH, stdin or store:ENTRY)", Validate: validateSecretSource, Context: true},
+	{Name: "client_key", Type: stringType, Description: "PEM file with the admin client key (client_jwt authentication)", Context: true},
+	{Name: "client_key_id", Type: stringType, Description: "key id of the admin client key (client_jwt authentication)", Context: true},
+	{Name: "tls_ca_bundle", Type: stringType, Description: "PEM file with additional certificate authorities to trust", Context: true},
+	{Name: "tls_client_cert", Type: stringType, Description: "PEM file with the client certificate used for mutual TLS", Context: true},
+	{Name: "tls_client_key", Type: stringType, Description: "PEM file with the client key used for mutual TLS", Context: true},
+	{Name: "tls_min_version", Type: enumType, Description: "minimum TLS version", Values: []string{"1.0", "1.1", "1.2", "1.3"}, Context: true},
+	{Name: "tls_insecure_skip_verify", Type: boolType, Default: false, Description: "do not verify the server certificate (insecure)", Context: true},
+	{Name: "workers", Type: intType, Default: 5, Description: "number of workers sending requests to Keycloak", Validate: validatePositive, Context: true},
+	{Name: "http_timeout", Type: intType, Default: 30, Description: "HTTP timeout in seconds", Validate: validatePositive, Context: true},
+	{Name: "current_context", Type: stringType, Description: "connection context used by default (see 'kci config use-context')"},
+}
+
+func lookupConfigKey(name string) (configKey, bool) {
+	name = strings.ToLower(name)
+	for _, key := range configKeys {
+		if key.Name == name {
+			return key, true
+		}
+	}
+	return configKey{}, false
+}
+
+// Parse checks a raw value against the key definition and converts it to
+// the key type.
+func (key configKey) Parse(raw string) (interface{}, error) {
+	var value interface{} = raw
+
+	switch key.Type {
+	case intType:
+		i, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' expects an integer, got '%s'", key.Name, raw)
+		}
+		value = i
+	case boolType:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' expects a boolean (true or false), got '%s'", key.Name, raw)
+		}
+		value = b
+	case enumType:
+		found := false
+		for _, v := range key.Values {
+			found = found || v == raw
+		}
+		if !found {
+			return nil, fmt.Errorf("'%s' expects one of %s, got '%s'", key.Name, strings.Join(key.Values, ", "), raw)
+		}
+	}
+
+	if key.Validate != nil {
+		err := key.Validate(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for '%s': %s", key.Name, err)
+		}
+	}
+
+	return value, nil
+}
+
+// TypeName returns the type of the key, as displayed to the user
+func (key configKey) TypeName() string {
+	if key.Type == enumType {
+		return strings.Join(key.Values, "|")
+	}
+	return key.Type
+}
+
+func validateURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("'%s' is not an http(s) URL", value)
+	}
+	return nil
+}
+
+func validatePositive(value string) error {
+	i, _ := strconv.Atoi(value)
+	if i <= 0 {
+		return fmt.Errorf("%d is not a positive number", i)
+	}
+	return nil
+}
+
+func validateSecretSource(value string) error {
+	for _, prefix := range []string{"env:", "file:", "store:"} {
+		if strings.HasPrefix(value, prefix) && len(value) > len(prefix) {
+			return nil
+		}
+	}
+	if value == "stdin" {
+		return nil
+	}
+	return fmt.Errorf("'%s' is not a valid secret source (env:NAME, file:PATH, stdin or store:ENTRY)", value)
+}
+
+func init() {
+	for _, key := range configKeys {
+		if key.Default != nil {
+			viper.SetDefault(key.Name, key.Default)
+		}
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 
 	"github.com/spf13/cobra"
 
@@ -29,7 +30,7 @@ import (
 	"github.com/spf13/viper"
 )
 
-var cfgFile string
+var cfgFile, configFilePath, contextName string
 var logger *log.Logger
 
 // rootCmd represents the base command when called without any subcommands
@@ -58,7 +59,8 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.cli.yaml)")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.kci.yaml)")
+	rootCmd.PersistentFlags().StringVar(&contextName, "context", "", "name of the connection context to use (default is the current context)")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -70,6 +72,7 @@ func initConfig() {
 	if cfgFile != "" {
 		// Use config file from the flag.
 		viper.SetConfigFile(cfgFile)
+		configFilePath = cfgFile
 	} else {
 		// Find home directory.
 		home, err := homedir.Dir()
@@ -82,6 +85,7 @@ func initConfig() {
 		viper.AddConfigPath(home)
 		viper.SetConfigName(".kci")
 		viper.SetConfigType("yaml")
+		configFilePath = filepath.Join(home, ".kci.yaml")
 	}
 
 	viper.AutomaticEnv() // read in environment variables that match
@@ -90,4 +94,8 @@ func initConfig() {
 	if err := viper.ReadInConfig(); err == nil {
 		logger.Println("Using config file:", viper.ConfigFileUsed())
 	}
+
+	if err := applyContext(); err != nil {
+		logger.Fatal(err)
+	}
 }
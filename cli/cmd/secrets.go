@@ -0,0 +1,339 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// Environment variable holding the passphrase of the secret store
+const passphraseEnv = "KCI_PASSPHRASE"
+
+// Mask displayed instead of secret values
+const secretMask = "********"
+
+// scrypt parameters used to derive the secret store key from the passphrase
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+var showSecrets bool
+
+// secretStore is the on-disk format of the encrypted secret store
+type secretStore struct {
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// setSecretCmd represents the set-secret command
+var setSecretCmd = &cobra.Command{
+	Use:   "set-secret KEY",
+	Short: "Store a secret in the encrypted secret store",
+	Long: `Store a secret (password or client_secret) in the encrypted secret store.
+The secret is read from stdin and the store is protected by a passphrase,
+read from the KCI_PASSPHRASE environment variable or asked interactively.
+The configuration is updated to read the secret from the store.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		key := args[0]
+		if !isSecretKey(key) {
+			logger.Fatalf("'%s' is not a secret\n", key)
+		}
+
+		secret, err := readSecret("Secret: ")
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		passphrase, err := readPassphrase()
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		secrets, err := loadSecretStore(passphrase)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		config, err := loadConfigFile()
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		// Secrets of a context are stored under the context name
+		entry := key
+		if name := activeContextName(); name != "" {
+			entry = "contexts." + name + "." + key
+		}
+
+		secrets[entry] = secret
+		err = saveSecretStore(passphrase, secrets)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		// Do not leave the plaintext secret behind
+		config, _ = unsetConfigKey(config, entry)
+		config.Set(entry+"_from", "store:"+entry)
+		err = saveConfigFile(config)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	},
+}
+
+// resolveSecret returns the value of a secret configuration key. When
+// "<key>_from" is set, the secret is read from the given source:
+//   - "env:NAME" reads the NAME environment variable,
+//   - "file:PATH" reads the file content (such as a mounted Kubernetes secret),
+//   - "stdin" reads a line from stdin,
+//   - "store:ENTRY" reads the entry from the encrypted secret store.
+//
+// Otherwise, the plaintext value of the key is returned.
+func resolveSecret(key string) (string, error) {
+	source := viper.GetString(key + "_from")
+	if source == "" {
+		return viper.GetString(key), nil
+	}
+
+	kind := source
+	var arg string
+	if i := strings.Index(source, ":"); i >= 0 {
+		kind, arg = source[:i], source[i+1:]
+	}
+
+	switch kind {
+	case "env":
+		value, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", fmt.Errorf("Environment variable %s (from %s_from) is not set", arg, key)
+		}
+		return value, nil
+	case "file":
+		content, err := ioutil.ReadFile(arg)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	case "stdin":
+		return readSecret(fmt.Sprintf("%s: ", key))
+	case "store":
+		passphrase, err := readPassphrase()
+		if err != nil {
+			return "", err
+		}
+
+		secrets, err := loadSecretStore(passphrase)
+		if err != nil {
+			return "", err
+		}
+
+		value, ok := secrets[arg]
+		if !ok {
+			return "", fmt.Errorf("No secret named '%s' in the secret store", arg)
+		}
+		return value, nil
+	}
+
+	return "", fmt.Errorf("Unknown secret source '%s' in %s_from (valid sources are env:NAME, file:PATH, stdin and store:ENTRY)", source, key)
+}
+
+func isSecretKey(key string) bool {
+	// Secrets of a context are named "contexts.<name>.<key>"
+	definition, known := lookupConfigKey(key[strings.LastIndex(key, ".")+1:])
+	return known && definition.Secret
+}
+
+// maskSecret hides the value of a setting if it holds a secret, unless
+// --show-secrets is set. Nested settings (contexts) are masked as well.
+func maskSecret(key string, value interface{}) interface{} {
+	if showSecrets {
+		return value
+	}
+
+	if settings, ok := value.(map[string]interface{}); ok {
+		masked := make(map[string]interface{}, len(settings))
+		for k, v := range settings {
+			masked[k] = maskSecret(key+"."+k, v)
+		}
+		return masked
+	}
+
+	if isSecretKey(key) && value != nil && value != "" {
+		return secretMask
+	}
+
+	return value
+}
+
+// stdinReader is shared by the secrets read from stdin, since a buffered
+// reader reads ahead of the line it returns
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// stdinSecret returns the first of the keys whose secret is read from stdin,
+// or an empty string
+func stdinSecret(keys ...string) string {
+	for _, key := range keys {
+		if viper.GetString(key+"_from") == "stdin" {
+			return key
+		}
+	}
+	return ""
+}
+
+// readSecret reads a secret from the terminal, without echo, or a line from
+// stdin when it is not a terminal.
+func readSecret(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("Cannot read %s from stdin: %s", strings.TrimSuffix(prompt, ": "), err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func readPassphrase() (string, error) {
+	if passphrase, ok := os.LookupEnv(passphraseEnv); ok {
+		return passphrase, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("The secret store passphrase must be given in the %s environment variable", passphraseEnv)
+	}
+
+	return readSecret("Secret store passphrase: ")
+}
+
+func secretStorePath() string {
+	return configFilePath + ".secrets"
+}
+
+func loadSecretStore(passphrase string) (map[string]string, error) {
+	secrets := make(map[string]string)
+
+	content, err := ioutil.ReadFile(secretStorePath())
+	if os.IsNotExist(err) {
+		return secrets, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var store secretStore
+	err = json.Unmarshal(content, &store)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the secret store %s: %s", secretStorePath(), err)
+	}
+
+	aead, err := newSecretCipher(passphrase, store.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := aead.Open(nil, store.Nonce, store.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decrypt the secret store %s (wrong passphrase?)", secretStorePath())
+	}
+
+	err = json.Unmarshal(data, &secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+func saveSecretStore(passphrase string, secrets map[string]string) error {
+	var store secretStore
+	store.Salt = make([]byte, 16)
+	_, err := rand.Read(store.Salt)
+	if err != nil {
+		return err
+	}
+
+	aead, err := newSecretCipher(passphrase, store.Salt)
+	if err != nil {
+		return err
+	}
+
+	store.Nonce = make([]byte, aead.NonceSize())
+	_, err = rand.Read(store.Nonce)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	store.Data = aead.Seal(nil, store.Nonce, data, nil)
+
+	content, err := json.Marshal(store)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(secretStorePath(), content, 0600)
+}
+
+func newSecretCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func init() {
+	configCmd.AddCommand(setSecretCmd)
+	configCmd.PersistentFlags().BoolVar(&showSecrets, "show-secrets", false, "display secret values instead of masking them")
+}
@@ -20,10 +20,10 @@ package cmd
 
 import (
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var value string
+var forceSet bool
 
 // setCmd represents the set command
 var setCmd = &cobra.Command{
@@ -38,13 +38,27 @@ var setCmd = &cobra.Command{
 			return
 		}
 
-		viper.Set(args[0], value)
-		err := viper.SafeWriteConfig()
-		if err != nil {
-			err = viper.WriteConfig()
+		var typedValue interface{} = value
+		definition, known := lookupConfigKey(args[0])
+		if known {
+			var err error
+			typedValue, err = definition.Parse(value)
 			if err != nil {
 				logger.Fatal(err)
 			}
+		} else if !forceSet {
+			logger.Fatalf("Unknown configuration key '%s'. Use 'kci config describe' to list the known keys or --force to set it anyway.\n", args[0])
+		}
+
+		config, err := loadConfigFile()
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		config.Set(configFileKey(args[0]), typedValue)
+		err = saveConfigFile(config)
+		if err != nil {
+			logger.Fatal(err)
 		}
 	},
 }
@@ -52,4 +66,5 @@ var setCmd = &cobra.Command{
 func init() {
 	configCmd.AddCommand(setCmd)
 	setCmd.PersistentFlags().StringVar(&value, "value", "", "value to set")
+	setCmd.PersistentFlags().BoolVar(&forceSet, "force", false, "set the key even if it is unknown")
 }
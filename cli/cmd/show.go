@@ -20,6 +20,7 @@ package cmd
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -32,8 +33,22 @@ var showCmd = &cobra.Command{
 	Long:  `TODO`,
 	Run: func(cmd *cobra.Command, args []string) {
 		settings := viper.AllSettings()
-		for k, v := range settings {
-			fmt.Printf("%s: %v\n", k, v)
+
+		// Known keys first, in the order of their definition
+		for _, key := range configKeys {
+			if v, ok := settings[key.Name]; ok {
+				fmt.Printf("%s: %v\n", key.Name, maskSecret(key.Name, v))
+				delete(settings, key.Name)
+			}
+		}
+
+		others := make([]string, 0, len(settings))
+		for k := range settings {
+			others = append(others, k)
+		}
+		sort.Strings(others)
+		for _, k := range others {
+			fmt.Printf("%s: %v\n", k, maskSecret(k, settings[k]))
 		}
 	},
 }
@@ -0,0 +1,58 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// unsetCmd represents the unset command
+var unsetCmd = &cobra.Command{
+	Use:   "unset",
+	Short: "Remove a key from the current configuration",
+	Long:  `Remove a key from the configuration file (or from the active context), so that its default value applies again.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			logger.Println("No configuration key specified")
+			logger.Println()
+			cmd.Help()
+			return
+		}
+
+		config, err := loadConfigFile()
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		config, found := unsetConfigKey(config, configFileKey(args[0]))
+		if !found {
+			logger.Printf("Configuration key '%s' is not set\n", args[0])
+			return
+		}
+
+		err = saveConfigFile(config)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	configCmd.AddCommand(unsetCmd)
+}
@@ -0,0 +1,240 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"fmt"
+	"strings"
+
+	keycloak "github.com/nmasse-itix/keycloak-client"
+)
+
+// Fields referencing the realm by its ID
+var realmReferences = map[string]bool{
+	"containerId": true,
+	"parentId":    true,
+}
+
+// CloneOptions describes how a realm file is imported as several realms
+type CloneOptions struct {
+	// Number of clones (the realm file is imported as is when zero)
+	Count int
+	// Format of the realm names, given the index of the clone, starting at
+	// zero (<realm>_%03d by default)
+	NameFormat string
+	// Whether the client secrets are regenerated
+	RegenerateSecrets bool
+	// Seed of the regenerated IDs and secrets
+	Seed int64
+}
+
+// Validate checks the count and the format of the realm names
+func (options CloneOptions) Validate() error {
+	if options.Count < 0 {
+		return fmt.Errorf("Invalid clone count %d", options.Count)
+	}
+	if options.NameFormat == "" {
+		return nil
+	}
+
+	first, second := fmt.Sprintf(options.NameFormat, 0), fmt.Sprintf(options.NameFormat, 1)
+	if strings.Contains(first, "%!") {
+		return fmt.Errorf("Invalid realm name format '%s' (it takes the index of the clone, such as 'tenant_%%04d')", options.NameFormat)
+	}
+	if first == second {
+		return fmt.Errorf("Invalid realm name format '%s' (the index of the clone is missing)", options.NameFormat)
+	}
+	return nil
+}
+
+func (options CloneOptions) realmName(realm string, index int) string {
+	format := options.NameFormat
+	if format == "" {
+		format = strings.ReplaceAll(realm, "%", "%%") + "_%03d"
+	}
+	return fmt.Sprintf(format, index)
+}
+
+// CloneRealmFile decodes a realm file, applies the patches and calls fn with
+// each clone of the realm, one at a time. The realm ID and name of the clones
+// are rewritten and the IDs of their objects (clients, users, roles, etc.)
+// are regenerated, since they are unique across realms.
+func CloneRealmFile(input RealmInput, patches []RealmPatch, options CloneOptions, fn func(realm keycloak.RealmRepresentation) error) error {
+	original, err := decodePatchedRealm(input, patches)
+	if err != nil {
+		return err
+	}
+
+	root, ok := original.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Cannot clone %s: the realm is not an object", input.Name)
+	}
+
+	realmID, _ := root["id"].(string)
+	realmName, _ := root["realm"].(string)
+	if realmName == "" {
+		realmName = realmID
+	}
+
+	for i := 0; i < options.Count; i++ {
+		name := options.realmName(realmName, i)
+		clone := cloneRealm(root, realmID, name, options)
+
+		var realm keycloak.RealmRepresentation
+		err := convertRealm(fmt.Sprintf("%s (clone %s)", input.Name, name), clone, &realm)
+		if err != nil {
+			return err
+		}
+
+		err = fn(realm)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CloneUsersFile decodes a <realm>-users-<n>.json file, applies the patches
+// and calls fn with the users of each clone of the realm, as CloneRealmFile
+// does.
+func CloneUsersFile(input RealmInput, realmName string, patches []RealmPatch, options CloneOptions, fn func(usersFile UsersFile) error) error {
+	patched, err := decodePatchedRealm(input, patches)
+	if err != nil {
+		return err
+	}
+
+	original, ok := patched.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Cannot clone %s: the users file is not an object", input.Name)
+	}
+
+	if name, ok := original["realm"].(string); ok && name != "" {
+		realmName = name
+	}
+
+	for i := 0; i < options.Count; i++ {
+		name := options.realmName(realmName, i)
+		c := realmClone{name: name, seed: options.Seed, ids: make(map[string]string)}
+		clone := c.clone(original)
+		clone["realm"] = name
+
+		var usersFile UsersFile
+		err := convertRealm(fmt.Sprintf("%s (clone %s)", input.Name, name), clone, &usersFile)
+		if err != nil {
+			return err
+		}
+
+		err = fn(usersFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// realmClone maps the IDs of the original realm to the IDs of a clone
+type realmClone struct {
+	name    string
+	realmID string
+	seed    int64
+	ids     map[string]string
+}
+
+func cloneRealm(original map[string]interface{}, realmID, name string, options CloneOptions) map[string]interface{} {
+	c := realmClone{name: name, realmID: realmID, seed: options.Seed, ids: make(map[string]string)}
+	clone := c.clone(original)
+	clone["id"] = name
+	clone["realm"] = name
+
+	if options.RegenerateSecrets {
+		clients, _ := clone["clients"].([]interface{})
+		for _, item := range clients {
+			client, ok := item.(map[string]interface{})
+			if _, hasSecret := client["secret"]; ok && hasSecret {
+				client["secret"] = randomUUID(keyedRand(c.seed, "secret", name, client["clientId"]))
+			}
+		}
+	}
+
+	return clone
+}
+
+// clone copies the document (without its own ID) and regenerates the IDs.
+// The new IDs only depend on the seed, the realm name and the original IDs,
+// so that the realm file and its users files agree.
+func (c *realmClone) clone(original map[string]interface{}) map[string]interface{} {
+	clone := copyValue(original).(map[string]interface{})
+	delete(clone, "id")
+	c.collectIDs(clone)
+	c.rewrite(clone)
+	return clone
+}
+
+// collectIDs gives a new ID to every object of the realm
+func (c *realmClone) collectIDs(node interface{}) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if id, ok := value.(string); ok && key == "id" && id != "" {
+				c.ids[id] = randomUUID(keyedRand(c.seed, "id", c.name, id))
+				continue
+			}
+			c.collectIDs(value)
+		}
+	case []interface{}:
+		for _, item := range v {
+			c.collectIDs(item)
+		}
+	}
+}
+
+// rewrite replaces the IDs and the references to them, including the
+// references to the realm.
+func (c *realmClone) rewrite(node interface{}) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if s, ok := value.(string); ok {
+				v[key] = c.rewriteString(s, realmReferences[key])
+				continue
+			}
+			c.rewrite(value)
+		}
+	case []interface{}:
+		for i, item := range v {
+			if s, ok := item.(string); ok {
+				v[i] = c.rewriteString(s, false)
+				continue
+			}
+			c.rewrite(item)
+		}
+	}
+}
+
+func (c *realmClone) rewriteString(s string, realmReference bool) string {
+	if id, ok := c.ids[s]; ok {
+		return id
+	}
+	if realmReference && s == c.realmID && s != "" {
+		return c.name
+	}
+	return s
+}
@@ -0,0 +1,122 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Extension of gzip-compressed files
+const GzipExtension = ".gz"
+
+// Magic bytes at the start of gzip-compressed content
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// NewRealmReader returns a reader of the content of r, decompressed on the
+// fly when it is gzip-compressed.
+func NewRealmReader(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if !bytes.Equal(magic, gzipMagic) {
+		return buffered, nil
+	}
+
+	return gzip.NewReader(buffered)
+}
+
+// realmFile is a realm file, being decompressed
+type realmFile struct {
+	io.Reader
+	file *os.File
+}
+
+func (f *realmFile) Close() error {
+	return f.file.Close()
+}
+
+// OpenRealmFile opens a realm file, decompressed on the fly when it has the
+// .gz extension or starts with the gzip magic bytes.
+func OpenRealmFile(filename string) (io.ReadCloser, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader
+	if strings.HasSuffix(filename, GzipExtension) {
+		r, err = gzip.NewReader(bufio.NewReader(file))
+	} else {
+		r, err = NewRealmReader(file)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Cannot decompress %s: %s", filename, err)
+	}
+
+	return &realmFile{Reader: r, file: file}, nil
+}
+
+// createdFile is a file created by CreateRealmFile
+type createdFile struct {
+	*bufio.Writer
+	file       *os.File
+	compressor *gzip.Writer
+}
+
+// CreateRealmFile creates a file, written through a buffer and
+// gzip-compressed when requested. Closing it flushes the pending writes.
+func CreateRealmFile(filename string, compress bool) (io.WriteCloser, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &createdFile{file: file}
+	if compress {
+		f.compressor = gzip.NewWriter(file)
+		f.Writer = bufio.NewWriterSize(f.compressor, 64*1024)
+	} else {
+		f.Writer = bufio.NewWriterSize(file, 64*1024)
+	}
+	return f, nil
+}
+
+// Close flushes the buffer and the compressor, then closes the file
+func (f *createdFile) Close() error {
+	err := f.Flush()
+	if f.compressor != nil {
+		if compressErr := f.compressor.Close(); err == nil {
+			err = compressErr
+		}
+	}
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
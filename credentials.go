@@ -0,0 +1,178 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Password hashing algorithms supported by Keycloak out of the box
+const (
+	PBKDF2SHA256 = "pbkdf2-sha256"
+	PBKDF2SHA512 = "pbkdf2-sha512"
+)
+
+// Number of iterations used by the default Keycloak password policy
+const DefaultHashIterations = 27500
+
+// Keycloak derives 512 bits keys and uses 16 bytes salts
+const (
+	derivedKeySize = 64
+	saltSize       = 16
+)
+
+// GeneratedCredential is a password credential, hashed the way Keycloak
+// stores it, so that Keycloak does not have to hash it at import time.
+type GeneratedCredential struct {
+	SecretData     string
+	CredentialData string
+}
+
+type PasswordHashing struct {
+	Algorithm  string
+	Iterations int
+}
+
+type secretData struct {
+	Value                string            `json:"value"`
+	Salt                 string            `json:"salt"`
+	AdditionalParameters map[string]string `json:"additionalParameters"`
+}
+
+type credentialData struct {
+	HashIterations       int               `json:"hashIterations"`
+	Algorithm            string            `json:"algorithm"`
+	AdditionalParameters map[string]string `json:"additionalParameters"`
+}
+
+func (hashing PasswordHashing) hashFunction() (func() hash.Hash, error) {
+	switch hashing.Algorithm {
+	case PBKDF2SHA256:
+		return sha256.New, nil
+	case PBKDF2SHA512:
+		return sha512.New, nil
+	}
+
+	return nil, fmt.Errorf("Unknown password hashing algorithm '%s' (valid values are '%s' and '%s')", hashing.Algorithm, PBKDF2SHA256, PBKDF2SHA512)
+}
+
+// Validate checks the algorithm and the iteration count.
+func (hashing PasswordHashing) Validate() error {
+	_, err := hashing.hashFunction()
+	if err != nil {
+		return err
+	}
+
+	if hashing.Iterations <= 0 {
+		return fmt.Errorf("The number of hash iterations must be positive")
+	}
+
+	return nil
+}
+
+// HashPassword hashes a password with the given salt.
+func HashPassword(password string, salt []byte, hashing PasswordHashing) (GeneratedCredential, error) {
+	var credential GeneratedCredential
+
+	h, err := hashing.hashFunction()
+	if err != nil {
+		return credential, err
+	}
+
+	key := pbkdf2.Key([]byte(password), salt, hashing.Iterations, derivedKeySize, h)
+	secret, err := json.Marshal(secretData{
+		Value:                base64.StdEncoding.EncodeToString(key),
+		Salt:                 base64.StdEncoding.EncodeToString(salt),
+		AdditionalParameters: map[string]string{},
+	})
+	if err != nil {
+		return credential, err
+	}
+
+	data, err := json.Marshal(credentialData{
+		HashIterations:       hashing.Iterations,
+		Algorithm:            hashing.Algorithm,
+		AdditionalParameters: map[string]string{},
+	})
+	if err != nil {
+		return credential, err
+	}
+
+	credential.SecretData = string(secret)
+	credential.CredentialData = string(data)
+
+	return credential, nil
+}
+
+// HashPasswords hashes the password of every user of the realm, spreading
+// the work over the given number of goroutines. Salts are derived from the
+// seed, the realm and user IDs so that the generated files are reproducible.
+//
+// The users of streaming realms are hashed later, when they are generated.
+func HashPasswords(realm *GeneratedRealm, hashing PasswordHashing, parallelism int) error {
+	err := hashing.Validate()
+	if err != nil {
+		return err
+	}
+
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	if realm.streaming {
+		realm.hashing = &hashing
+		realm.parallelism = parallelism
+		return nil
+	}
+
+	users := make(chan *GeneratedUser)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for user := range users {
+				// The hashing configuration has been validated, this cannot fail
+				credential, _ := HashPassword(user.Password, passwordSalt(realm.Seed, realm.ID, user.ID), hashing)
+				user.Credential = &credential
+			}
+		}()
+	}
+
+	for i := range realm.Users {
+		users <- &realm.Users[i]
+	}
+	close(users)
+	wg.Wait()
+
+	return nil
+}
+
+func passwordSalt(seed int64, realmID, userID string) []byte {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("salt/%d/%s/%s", seed, realmID, userID)))
+	return sum[:saltSize]
+}
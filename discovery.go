@@ -0,0 +1,78 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Context path values
+const (
+	// Probe the server to find out whether it uses the "/auth" context path
+	AutoContextPath = "auto"
+	// Context path of the WildFly based Keycloak distributions (up to 16)
+	LegacyContextPath = "/auth"
+)
+
+// ResolveBaseURL returns the Keycloak base URL, the one under which the
+// "/realms" and "/admin" endpoints live. With AutoContextPath, the
+// OpenID Connect discovery document of the given realm is looked up with and
+// without the legacy "/auth" context path. Otherwise, contextPath is
+// appended to keycloakURL ("/" meaning no context path).
+func ResolveBaseURL(keycloakURL, contextPath, realm string, client *http.Client) (string, error) {
+	keycloakURL = strings.TrimSuffix(keycloakURL, "/")
+
+	if contextPath != AutoContextPath {
+		contextPath = strings.Trim(contextPath, "/")
+		if contextPath == "" {
+			return keycloakURL, nil
+		}
+		return keycloakURL + "/" + contextPath, nil
+	}
+
+	candidates := []string{keycloakURL}
+	if !strings.HasSuffix(keycloakURL, LegacyContextPath) {
+		candidates = append(candidates, keycloakURL+LegacyContextPath)
+	}
+
+	var errors []string
+	for _, candidate := range candidates {
+		discoveryURL := RealmURL(candidate, realm) + "/.well-known/openid-configuration"
+		resp, err := client.Get(discoveryURL)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK {
+			return candidate, nil
+		}
+		errors = append(errors, fmt.Sprintf("%s: %s", discoveryURL, resp.Status))
+	}
+
+	return "", fmt.Errorf("Cannot find the Keycloak base URL (%s)", strings.Join(errors, ", "))
+}
+
+// RealmURL returns the URL of a realm, as used for the token provider.
+func RealmURL(baseURL, realm string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/realms/" + url.PathEscape(realm)
+}
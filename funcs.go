@@ -0,0 +1,373 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Characters used by randString
+const randomAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// templateFunctions returns the functions available in realm templates, as
+// documented in the README. Random values are derived from the seed and the
+// keys given as arguments, so that the generated realms are reproducible.
+// Keyless UUIDs are drawn from a sequence initialized with the seed and the
+// realm ID, which is why a new set of functions is needed for each rendered
+// realm.
+func templateFunctions(seed int64, realmID string) template.FuncMap {
+	sequence := keyedRand(seed, "uuid", realmID)
+	return template.FuncMap{
+		"add":        add,
+		"sub":        subtract,
+		"mul":        multiply,
+		"div":        divide,
+		"mod":        modulo,
+		"min":        minimum,
+		"max":        maximum,
+		"atoi":       toInt,
+		"padLeft":    padLeft,
+		"padRight":   padRight,
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"title":      strings.Title,
+		"trim":       strings.TrimSpace,
+		"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"repeat":     repeat,
+		"randInt":    func(min, max interface{}, keys ...interface{}) (int, error) { return randInt(seed, min, max, keys...) },
+		"pick":       func(list interface{}, keys ...interface{}) (interface{}, error) { return pick(seed, list, keys...) },
+		"randString": func(n interface{}, keys ...interface{}) (string, error) { return randString(seed, n, keys...) },
+		"uuid":       func(keys ...interface{}) string { return uuidFrom(seed, sequence, keys...) },
+		"b64enc":     func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec":     b64dec,
+		"sha256":     func(s string) string { sum := sha256.Sum256([]byte(s)); return hex.EncodeToString(sum[:]) },
+		"json":       toJSON,
+		"jsonEscape": jsonEscape,
+		"now":        func() time.Time { return seededNow(seed) },
+		"date":       func(layout string, t time.Time) string { return t.Format(layout) },
+		"unix":       func(t time.Time) int64 { return t.Unix() },
+		"unixMillis": func(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) },
+		"addDays":    addDays,
+		"seq":        seq,
+		"list":       func(items ...interface{}) []interface{} { return items },
+		"join":       join,
+		"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+	}
+}
+
+// Time from which now is derived
+var nowReference = time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// seededNow returns the time of the generation: a time of the year following
+// nowReference, derived from the seed so that the same seed renders the same
+// realms.
+func seededNow(seed int64) time.Time {
+	offset := keyedRand(seed, "now").Int63n(int64(365 * 24 * time.Hour))
+	return nowReference.Add(time.Duration(offset)).Truncate(time.Second)
+}
+
+// Largest value of int
+const maxIntValue = int(^uint(0) >> 1)
+
+// toInt converts numbers and numeric strings (such as "000042") to int.
+// Floats are truncated.
+func toInt(v interface{}) (int, error) {
+	if s, ok := v.(string); ok {
+		i, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", s)
+		}
+		return i, nil
+	}
+
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := value.Int()
+		if i > int64(maxIntValue) || i < -int64(maxIntValue)-1 {
+			return 0, fmt.Errorf("number %d out of range", i)
+		}
+		return int(i), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := value.Uint()
+		if u > uint64(maxIntValue) {
+			return 0, fmt.Errorf("number %d out of range", u)
+		}
+		return int(u), nil
+	case reflect.Float32, reflect.Float64:
+		f := value.Float()
+		if math.IsNaN(f) || f >= float64(maxIntValue) || f < -float64(maxIntValue)-1 {
+			return 0, fmt.Errorf("number %v out of range", f)
+		}
+		return int(f), nil
+	}
+	return 0, fmt.Errorf("expected a number, got %T", v)
+}
+
+// toInts converts two values with toInt
+func toInts(a, b interface{}) (int, int, error) {
+	x, err := toInt(a)
+	if err != nil {
+		return 0, 0, err
+	}
+	y, err := toInt(b)
+	return x, y, err
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func add(a, b interface{}) (int, error) {
+	x, y, err := toInts(a, b)
+	return x + y, err
+}
+
+func subtract(a, b interface{}) (int, error) {
+	x, y, err := toInts(a, b)
+	return x - y, err
+}
+
+func multiply(a, b interface{}) (int, error) {
+	x, y, err := toInts(a, b)
+	return x * y, err
+}
+
+func minimum(a, b interface{}) (int, error) {
+	x, y, err := toInts(a, b)
+	return minInt(x, y), err
+}
+
+func maximum(a, b interface{}) (int, error) {
+	x, y, err := toInts(a, b)
+	return maxInt(x, y), err
+}
+
+func divide(a, b interface{}) (int, error) {
+	x, y, err := toInts(a, b)
+	if err != nil {
+		return 0, err
+	}
+	if y == 0 {
+		return 0, fmt.Errorf("division by zero")
+	}
+	return x / y, nil
+}
+
+func modulo(a, b interface{}) (int, error) {
+	x, y, err := toInts(a, b)
+	if err != nil {
+		return 0, err
+	}
+	if y == 0 {
+		return 0, fmt.Errorf("division by zero")
+	}
+	return x % y, nil
+}
+
+func repeat(count interface{}, s string) (string, error) {
+	n, err := toInt(count)
+	if err != nil {
+		return "", err
+	}
+	if n < 0 {
+		return "", fmt.Errorf("negative count %d", n)
+	}
+	return strings.Repeat(s, n), nil
+}
+
+func addDays(days interface{}, t time.Time) (time.Time, error) {
+	n, err := toInt(days)
+	return t.AddDate(0, 0, n), err
+}
+
+// padding returns the characters to add to v to make it width characters
+// long, the width and the pad character being counted in runes
+func padding(width interface{}, char string, v interface{}) (string, string, error) {
+	s := fmt.Sprint(v)
+	w, err := toInt(width)
+	if err != nil {
+		return "", "", err
+	}
+
+	n := w - utf8.RuneCountInString(s)
+	if n <= 0 || char == "" {
+		return s, "", nil
+	}
+
+	pad := []rune(strings.Repeat(char, n))
+	return s, string(pad[:n]), nil
+}
+
+func padLeft(width interface{}, char string, v interface{}) (string, error) {
+	s, pad, err := padding(width, char, v)
+	return pad + s, err
+}
+
+func padRight(width interface{}, char string, v interface{}) (string, error) {
+	s, pad, err := padding(width, char, v)
+	return s + pad, err
+}
+
+// keyedRand returns a random generator whose sequence only depends on the
+// seed and the keys, so that generated values do not change from one run to
+// another.
+func keyedRand(seed int64, keys ...interface{}) *rand.Rand {
+	h := fnv.New64a()
+	fmt.Fprint(h, seed)
+	for _, key := range keys {
+		h.Write([]byte{0})
+		fmt.Fprint(h, key)
+	}
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// randomUUID returns a version 4 UUID drawn from r
+func randomUUID(r *rand.Rand) string {
+	var u uuid.UUID
+	r.Read(u[:])
+	u[6] = (u[6] & 0x0f) | 0x40 // Version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // Variant is 10
+	return u.String()
+}
+
+func randInt(seed int64, min, max interface{}, keys ...interface{}) (int, error) {
+	lower, upper, err := toInts(min, max)
+	if err != nil {
+		return 0, err
+	}
+	if upper < lower {
+		return 0, fmt.Errorf("randInt: max (%d) is lower than min (%d)", upper, lower)
+	}
+	return lower + keyedRand(seed, keys...).Intn(upper-lower+1), nil
+}
+
+func pick(seed int64, list interface{}, keys ...interface{}) (interface{}, error) {
+	items := reflect.ValueOf(list)
+	if items.Kind() != reflect.Slice && items.Kind() != reflect.Array {
+		return nil, fmt.Errorf("pick: expected a list, got %T", list)
+	}
+	if items.Len() == 0 {
+		return nil, fmt.Errorf("pick: empty list")
+	}
+	return items.Index(keyedRand(seed, keys...).Intn(items.Len())).Interface(), nil
+}
+
+func randString(seed int64, length interface{}, keys ...interface{}) (string, error) {
+	n, err := toInt(length)
+	if err != nil {
+		return "", err
+	}
+	if n < 0 {
+		return "", fmt.Errorf("negative length %d", n)
+	}
+
+	r := keyedRand(seed, keys...)
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = randomAlphabet[r.Intn(len(randomAlphabet))]
+	}
+	return string(b), nil
+}
+
+func uuidFrom(seed int64, sequence *rand.Rand, keys ...interface{}) string {
+	if len(keys) == 0 {
+		return randomUUID(sequence)
+	}
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(fmt.Sprintln(append([]interface{}{seed}, keys...)...))).String()
+}
+
+func b64dec(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return string(b), err
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func jsonEscape(v interface{}) (string, error) {
+	b, err := json.Marshal(fmt.Sprint(v))
+	if err != nil {
+		return "", err
+	}
+	return string(b[1 : len(b)-1]), nil
+}
+
+// seq returns the integers from start (zero by default) to end, excluded.
+func seq(bounds ...interface{}) ([]int, error) {
+	var start, end int
+	var err error
+	switch len(bounds) {
+	case 1:
+		end, err = toInt(bounds[0])
+	case 2:
+		start, end, err = toInts(bounds[0], bounds[1])
+	default:
+		return nil, fmt.Errorf("seq: expected 1 or 2 arguments, got %d", len(bounds))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result []int
+	for i := start; i < end; i++ {
+		result = append(result, i)
+	}
+	return result, nil
+}
+
+func join(sep string, list interface{}) (string, error) {
+	items := reflect.ValueOf(list)
+	if items.Kind() != reflect.Slice && items.Kind() != reflect.Array {
+		return "", fmt.Errorf("join: expected a list, got %T", list)
+	}
+
+	parts := make([]string, items.Len())
+	for i := range parts {
+		parts[i] = fmt.Sprint(items.Index(i).Interface())
+	}
+	return strings.Join(parts, sep), nil
+}
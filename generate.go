@@ -20,32 +20,86 @@
 package kcimport
 
 import (
+	"bufio"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"text/template"
+	"time"
 
-	"github.com/google/uuid"
 	_ "github.com/nmasse-itix/keycloak-realm-import/statik"
 	"github.com/rakyll/statik/fs"
+	"golang.org/x/text/unicode/norm"
 )
 
 type GeneratedUser struct {
 	ID string
+	// Position of the user in the realm, starting at zero
+	Index       int
+	FirstName   string
+	LastName    string
+	Email       string
+	Locale      string
+	PhoneNumber string
+	// Custom attributes (department, city, employeeNumber)
+	Attributes map[string]string
+	// Paths of the groups the user is member of
+	Groups []string
+	// Names of the realm roles granted to the user
+	RealmRoles  []string
+	ClientRoles []GeneratedRoleMapping
+	Password    string
+	// Pre-hashed password, when requested (see HashPasswords)
+	Credential *GeneratedCredential
 }
 
 type GeneratedClient struct {
-	ID     string
+	ID string
+	// Position of the client in the realm, starting at zero
+	Index  int
 	Secret string
+	Roles  []GeneratedRole
 }
 
 type GeneratedRealm struct {
-	ID      string
+	ID string
+	// Name of the realm group of the generation spec
+	Group string
+	// Seed of the random values, recorded in the realm attributes
+	Seed    int64
 	Clients []GeneratedClient
 	Users   []GeneratedUser
+	// Top-level groups
+	Groups []GeneratedGroup
+	// Realm roles
+	Roles []GeneratedRole
+	// Template of the realm group, if any
+	Template *template.Template
+
+	// Streaming realms generate their users and clients on the fly (see
+	// StreamUsers and StreamClients)
+	streaming   bool
+	userCount   int
+	clientCount int
+	groupPaths  []string
+	membership  float64
+	roleSpec    RoleSpec
+	clientRoles []GeneratedRole
+	// Password hashing of streaming realms (see HashPasswords)
+	hashing     *PasswordHashing
+	parallelism int
+	// Closed when the rendering of the realm ends
+	stop <-chan struct{}
 }
 
+// errRenderingFailed stops the validation of a realm that failed to render
+var errRenderingFailed = errors.New("rendering failed")
+
 var defaultTemplate *template.Template
 var statikFS http.FileSystem
 
@@ -63,49 +117,241 @@ func init() {
 	}
 }
 
-func GenerateRealms(realmCount, clientCount, userCount int) []GeneratedRealm {
+// NewSeed returns a random seed, for when the user does not provide one
+func NewSeed() int64 {
+	var b [8]byte
+	_, err := cryptorand.Read(b[:])
+	if err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.BigEndian.Uint64(b[:]) >> 1)
+}
+
+// GenerateRealms generates the realms described by the spec. Their content
+// only depends on the seed and the spec.
+func GenerateRealms(seed int64, spec GenerationSpec) ([]GeneratedRealm, error) {
+	return generateRealms(seed, spec, false)
+}
+
+// GenerateStreamingRealms describes the realms of the spec without
+// generating their users and clients. They are generated on the fly, while
+// the realms are rendered, so that the memory used does not depend on the
+// number of users.
+func GenerateStreamingRealms(seed int64, spec GenerationSpec) ([]GeneratedRealm, error) {
+	return generateRealms(seed, spec, true)
+}
+
+func generateRealms(seed int64, spec GenerationSpec, streaming bool) ([]GeneratedRealm, error) {
+	err := spec.Validate()
+	if err != nil {
+		return nil, err
+	}
+
 	var realms []GeneratedRealm
-	for r := 0; r < realmCount; r++ {
-		realm := GenerateRealm(clientCount, userCount)
-		realm.ID = fmt.Sprintf("%003d", r)
-		realms = append(realms, realm)
+	ids := make(map[string]bool)
+	for _, group := range spec.Groups {
+		for i := 0; i < group.Realms; i++ {
+			id := group.realmID(i)
+			if ids[id] {
+				return nil, fmt.Errorf("Duplicate realm ID '%s' (check the name patterns of the realm groups)", id)
+			}
+			ids[id] = true
+
+			r := keyedRand(seed, "realm", id)
+			clientCount := group.Clients.Sample(r)
+			userCount := group.Users.Sample(r)
+
+			realm := generateRealm(seed, id, clientCount, userCount, group, streaming)
+			realm.Group = group.Name
+			realm.Template = group.template
+			realms = append(realms, realm)
+		}
 	}
-	return realms
+	return realms, nil
 }
 
-func GenerateRealm(clientCount, userCount int) GeneratedRealm {
+func GenerateRealm(seed int64, clientCount, userCount int) GeneratedRealm {
+	return generateRealm(seed, "", clientCount, userCount, RealmGroupSpec{}, false)
+}
+
+// generateRealm generates a realm with the group tree and roles described
+// by the realm group. The users and clients of streaming realms are
+// generated later, on the fly.
+func generateRealm(seed int64, id string, clientCount, userCount int, group RealmGroupSpec, streaming bool) GeneratedRealm {
 	var realm GeneratedRealm
+	realm.ID = id
+	realm.Seed = seed
+	realm.streaming = streaming
+	realm.userCount = userCount
+	realm.clientCount = clientCount
+	realm.Groups = generateGroups("", "", group.GroupTree.Depth, group.GroupTree.Fanout)
+	realm.groupPaths = groupPaths(realm.Groups)
+	realm.membership = group.GroupTree.Membership
+	realm.roleSpec = group.Roles
+	realm.Roles = generateRealmRoles(seed, id, group.Roles)
+	realm.clientRoles = generateClientRoles(group.Roles)
+
+	if streaming {
+		return realm
+	}
+
 	for c := 0; c < clientCount; c++ {
-		var client GeneratedClient
-		client.ID = fmt.Sprintf("%006d", c)
-		client.Secret = uuid.New().String()
-		realm.Clients = append(realm.Clients, client)
+		realm.Clients = append(realm.Clients, realm.generateClient(c))
 	}
 	for u := 0; u < userCount; u++ {
-		var user GeneratedUser
-		user.ID = fmt.Sprintf("%006d", u)
-		realm.Users = append(realm.Users, user)
+		realm.Users = append(realm.Users, realm.generateUser(u))
 	}
 	return realm
 }
 
+// generateClient generates a client of the realm, with its roles
+func (realm *GeneratedRealm) generateClient(index int) GeneratedClient {
+	client := GenerateClient(realm.Seed, realm.ID, index)
+	client.Roles = realm.clientRoles
+	return client
+}
+
+// generateUser generates a user of the realm, with its groups and roles
+func (realm *GeneratedRealm) generateUser(index int) GeneratedUser {
+	user := GenerateUser(realm.Seed, realm.ID, index)
+	realm.assignGroup(&user)
+	realm.assignRoles(&user)
+	return user
+}
+
+func clientID(index int) string {
+	return fmt.Sprintf("%006d", index)
+}
+
+// GenerateClient generates a confidential client. The secret only depends
+// on the seed, the realm ID and the client index.
+func GenerateClient(seed int64, realmID string, index int) GeneratedClient {
+	var client GeneratedClient
+	client.ID = clientID(index)
+	client.Index = index
+	client.Secret = randomUUID(keyedRand(seed, "client", realmID, client.ID))
+	return client
+}
+
+// GenerateUser generates a user with a realistic profile. The profile only
+// depends on the seed, the realm ID and the user index.
+func GenerateUser(seed int64, realmID string, index int) GeneratedUser {
+	var user GeneratedUser
+	user.ID = fmt.Sprintf("%006d", index)
+	user.Index = index
+	user.Password = fmt.Sprintf("user_%s", user.ID)
+
+	r := keyedRand(seed, "user", realmID, user.ID)
+	user.FirstName = firstNames[r.Intn(len(firstNames))]
+	user.LastName = lastNames[r.Intn(len(lastNames))]
+
+	// The user ID keeps the email unique within the realm
+	domain := emailDomains[r.Intn(len(emailDomains))]
+	user.Email = fmt.Sprintf("%s.%s.%s@%s", emailLocalPart(user.FirstName), emailLocalPart(user.LastName), user.ID, domain)
+
+	locale := locales[r.Intn(len(locales))]
+	user.Locale = locale.Locale
+	user.PhoneNumber = fmt.Sprintf("+%s%09d", locale.CountryCode, r.Intn(1000000000))
+
+	user.Attributes = map[string]string{
+		"department":     departments[r.Intn(len(departments))],
+		"city":           cities[r.Intn(len(cities))],
+		"employeeNumber": fmt.Sprintf("E%07d", r.Intn(10000000)),
+	}
+
+	return user
+}
+
+// emailLocalPart turns a name into a suitable email local part: lower case,
+// without accents, spaces or punctuation.
+func emailLocalPart(name string) string {
+	var b strings.Builder
+	for _, c := range norm.NFD.String(strings.ToLower(name)) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
 func WriteRealmFileWithTemplate(realm GeneratedRealm, out io.Writer, template *template.Template) error {
 	if template == nil {
 		return fmt.Errorf("No template provided")
 	}
 
-	return template.Execute(out, realm)
+	if realm.streaming {
+		err := checkStreamingTemplate(template)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Bind the random functions to the seed of the realm
+	tmpl, err := template.Clone()
+	if err != nil {
+		return err
+	}
+
+	// The users and clients of the realm stop being generated when the
+	// rendering ends, even if it fails
+	stop := make(chan struct{})
+	defer close(stop)
+	rendered := realm
+	rendered.stop = stop
+
+	// Catch template mistakes now rather than at import time: the realm is
+	// validated as it is rendered
+	pr, pw := io.Pipe()
+	validation := make(chan error, 1)
+	var offset int
+	go func() {
+		var err error
+		rendered := bufio.NewReader(pr)
+		if isYAML("", rendered) {
+			offset, err = validateYAMLRealm(rendered)
+		} else {
+			offset, err = validateRealm(rendered)
+		}
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			// Drain the rest of the output, if any
+			_, err = io.Copy(ioutil.Discard, pr)
+		}
+		validation <- err
+	}()
+
+	buffered := bufio.NewWriterSize(io.MultiWriter(out, pw), 64*1024)
+	err = tmpl.Funcs(templateFunctions(realm.Seed, realm.ID)).Execute(buffered, rendered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		pw.CloseWithError(errRenderingFailed)
+	} else {
+		pw.Close()
+	}
+
+	// When the validation fails first, the rendering fails with the same error
+	validationErr := <-validation
+	if validationErr != nil && validationErr != errRenderingFailed && (err == nil || err == validationErr) {
+		return newTemplateError(realm, template, offset, validationErr)
+	}
+	return err
 }
+
+// WriteRealmFile renders the realm with the template of its group, or the
+// default template.
 func WriteRealmFile(realm GeneratedRealm, out io.Writer) error {
+	if realm.Template != nil {
+		return WriteRealmFileWithTemplate(realm, out, realm.Template)
+	}
 	return WriteRealmFileWithTemplate(realm, out, defaultTemplate)
 }
 
 func GetRealmTemplate(content string) (*template.Template, error) {
 	tmpl := template.New("realm")
-	customFunctions := template.FuncMap{
-		// TODO
-	}
-	return tmpl.Funcs(customFunctions).Parse(content)
+	return tmpl.Funcs(templateFunctions(0, "")).Parse(content)
 }
 
 func getTemplate(statikFS http.FileSystem, filename string) (*template.Template, error) {
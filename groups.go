@@ -0,0 +1,101 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"fmt"
+)
+
+// GeneratedGroup is a group of the generated group tree
+type GeneratedGroup struct {
+	ID   string
+	Name string
+	// Path of the group, as used by Keycloak (/parent/child)
+	Path      string
+	SubGroups []GeneratedGroup
+}
+
+// GroupTreeSpec describes the group tree of a realm
+type GroupTreeSpec struct {
+	// Number of levels of the tree (no groups when zero)
+	Depth int `yaml:"depth"`
+	// Number of sub-groups of each group (and of top-level groups)
+	Fanout int `yaml:"fanout"`
+	// Share of the users being member of a group (between 0 and 1)
+	Membership float64 `yaml:"membership"`
+}
+
+// Validate checks the shape of the tree and the membership ratio
+func (tree GroupTreeSpec) Validate() error {
+	if tree.Depth < 0 || tree.Fanout < 0 {
+		return fmt.Errorf("The depth and fanout of the group tree cannot be negative")
+	}
+	if tree.Depth > 0 && tree.Fanout == 0 {
+		return fmt.Errorf("The fanout of the group tree must be positive")
+	}
+	if tree.Membership < 0 || tree.Membership > 1 {
+		return fmt.Errorf("The group membership ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// generateGroups generates a tree of the given depth and fanout. Group IDs
+// are the indexes of the group and its ancestors (001_002 is the third
+// child of the second top-level group).
+func generateGroups(parentID, parentPath string, depth, fanout int) []GeneratedGroup {
+	if depth <= 0 {
+		return nil
+	}
+
+	groups := make([]GeneratedGroup, fanout)
+	for i := range groups {
+		group := &groups[i]
+		group.ID = fmt.Sprintf("%03d", i)
+		if parentID != "" {
+			group.ID = parentID + "_" + group.ID
+		}
+		group.Name = "group_" + group.ID
+		group.Path = parentPath + "/" + group.Name
+		group.SubGroups = generateGroups(group.ID, group.Path, depth-1, fanout)
+	}
+	return groups
+}
+
+// groupPaths lists the paths of all the groups of the tree
+func groupPaths(groups []GeneratedGroup) []string {
+	var paths []string
+	for _, group := range groups {
+		paths = append(paths, group.Path)
+		paths = append(paths, groupPaths(group.SubGroups)...)
+	}
+	return paths
+}
+
+// assignGroup makes a share of the users member of one group, picked at
+// random among all the groups of the tree.
+func (realm *GeneratedRealm) assignGroup(user *GeneratedUser) {
+	if len(realm.groupPaths) == 0 {
+		return
+	}
+
+	r := keyedRand(realm.Seed, "groups", realm.ID, user.ID)
+	if r.Float64() < realm.membership {
+		user.Groups = []string{realm.groupPaths[r.Intn(len(realm.groupPaths))]}
+	}
+}
@@ -19,21 +19,47 @@
 package kcimport
 
 import (
+	"crypto/rsa"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
 
 	keycloak "github.com/nmasse-itix/keycloak-client"
 )
 
+// Methods used to authenticate against the Keycloak admin API
+const (
+	// Resource Owner Password Credentials grant with a login and a password
+	PasswordAuth = "password"
+	// Client Credentials grant with a client id and a client secret
+	ClientSecretAuth = "client_secret"
+	// Client Credentials grant with a client id and a JWT signed by the client key
+	ClientJWTAuth = "client_jwt"
+)
+
 type KeycloakCredentials struct {
-	Realm    string
-	Login    string
-	Password string
+	Realm        string
+	AuthMethod   string
+	Login        string
+	Password     string
+	ClientID     string
+	ClientSecret string
+	ClientKey    *rsa.PrivateKey
+	ClientKeyID  string
 }
 
 type KeycloakImporter struct {
 	Client      *keycloak.Client
 	Token       string
+	OIDCToken   OIDCToken
 	Credentials KeycloakCredentials
+	tokenURL    string
+	adminURL    string
+	httpClient  *http.Client
+	// IDs of the clients and roles, by realm (see rolemappings.go)
+	clientIDs map[string]string
+	roles     map[string]map[string]roleReference
 }
 
 type ImportError struct {
@@ -54,28 +80,91 @@ func NewKeycloakImporter(config keycloak.Config) (KeycloakImporter, error) {
 	}
 
 	importer.Client = kcClient
+	importer.tokenURL = strings.TrimSuffix(config.AddrTokenProvider, "/") + "/protocol/openid-connect/token"
+	importer.adminURL = strings.TrimSuffix(config.AddrAPI, "/") + "/admin/realms/"
+	importer.httpClient = NewHTTPClient(config.Timeout)
+	importer.clientIDs = make(map[string]string)
+	importer.roles = make(map[string]map[string]roleReference)
 
 	return importer, nil
 }
 
 func (importer *KeycloakImporter) Login() error {
-	token, err := importer.Client.GetToken(importer.Credentials.Realm, importer.Credentials.Login, importer.Credentials.Password)
+	form := url.Values{}
+	switch importer.Credentials.AuthMethod {
+	case PasswordAuth, "":
+		form.Set("grant_type", "password")
+		form.Set("username", importer.Credentials.Login)
+		form.Set("password", importer.Credentials.Password)
+	case ClientSecretAuth, ClientJWTAuth:
+		form.Set("grant_type", "client_credentials")
+	default:
+		return fmt.Errorf("Unknown authentication method '%s'", importer.Credentials.AuthMethod)
+	}
+
+	err := importer.authenticateClient(form)
 	if err != nil {
 		return err
 	}
 
-	importer.Token = token
+	token, err := importer.requestToken(form)
+	if err != nil {
+		return err
+	}
+
+	importer.setToken(token)
 
 	return nil
 }
 
+// RefreshToken renews the OIDC token using the refresh token when there is
+// a valid one and falls back to a full login otherwise.
+func (importer *KeycloakImporter) RefreshToken() error {
+	if importer.OIDCToken.CanRefresh() {
+		form := url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {importer.OIDCToken.RefreshToken},
+		}
+		err := importer.authenticateClient(form)
+		if err != nil {
+			return err
+		}
+
+		token, err := importer.requestToken(form)
+		if err == nil {
+			importer.setToken(token)
+			return nil
+		}
+	}
+
+	return importer.Login()
+}
+
+// RealmName returns the name of the realm, used in the paths of the admin
+// API, or its ID when the name is missing. Exported realms have an ID that
+// differs from their name.
+func RealmName(realm keycloak.RealmRepresentation) (string, error) {
+	if realm.Realm != nil && *realm.Realm != "" {
+		return *realm.Realm, nil
+	}
+	if realm.ID != nil && *realm.ID != "" {
+		return *realm.ID, nil
+	}
+	return "", fmt.Errorf("Missing realm name in RealmRepresentation")
+}
+
 func (importer *KeycloakImporter) ApplyRealm(realm keycloak.RealmRepresentation) error {
-	_, err := importer.Client.CreateRealm(importer.Token, realm)
+	realmName, err := RealmName(realm)
+	if err != nil {
+		return err
+	}
+
+	_, err = importer.Client.CreateRealm(importer.Token, realm)
 	if err != nil {
 		err := normalizeError(err)
 		switch {
 		case err.StatusCode == 409:
-			err := importer.Client.UpdateRealm(importer.Token, *realm.ID, realm)
+			err := importer.Client.UpdateRealm(importer.Token, realmName, realm)
 			if err != nil {
 				err := normalizeError(err)
 				return err
@@ -0,0 +1,305 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the standard input, as an input
+const StdinInput = "-"
+
+// Files picked in directories and archives, by default
+var DefaultIncludes = []string{"*.json", "*.json.gz", "*.yaml", "*.yaml.gz", "*.yml", "*.yml.gz"}
+
+// RealmInput is a realm file read from a file, the standard input or an
+// archive. Its content is decompressed on the fly.
+type RealmInput struct {
+	// Path of the file, or of the archive entry (<archive>/<entry>)
+	Name string
+	io.Reader
+}
+
+// InputSource lists realm files, one at a time
+type InputSource interface {
+	// Next returns the next realm file, or io.EOF when there are no more.
+	// The previous realm file cannot be read anymore.
+	Next() (RealmInput, error)
+	Close() error
+}
+
+// InputFilter picks the files of directories and archives by their name,
+// with glob patterns (see path.Match) matched against the name of the file
+// and its path.
+type InputFilter struct {
+	Includes []string
+	Excludes []string
+}
+
+// Match tells whether the file is picked by the filter
+func (filter InputFilter) Match(name string) bool {
+	includes := filter.Includes
+	if len(includes) == 0 {
+		includes = DefaultIncludes
+	}
+	return matchAny(includes, name) && !filter.matchExcludes(name)
+}
+
+func (filter InputFilter) matchExcludes(name string) bool {
+	return matchAny(filter.Excludes, name)
+}
+
+// Validate checks the syntax of the patterns
+func (filter InputFilter) Validate() error {
+	for _, pattern := range append(append([]string{}, filter.Includes...), filter.Excludes...) {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("Invalid pattern '%s': %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	name = filepath.ToSlash(name)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, path.Base(name)); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenInputs returns the realm files of the arguments: files, directories
+// (walked recursively), tar archives (compressed or not) and the standard
+// input ("-"). Files given explicitly are not filtered.
+func OpenInputs(args []string, filter InputFilter) (InputSource, error) {
+	err := filter.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &multiSource{args: args, filter: filter}, nil
+}
+
+// multiSource chains the sources of several arguments
+type multiSource struct {
+	args    []string
+	filter  InputFilter
+	current InputSource
+}
+
+func (s *multiSource) Next() (RealmInput, error) {
+	for {
+		if s.current != nil {
+			input, err := s.current.Next()
+			if err != io.EOF {
+				return input, err
+			}
+
+			err = s.current.Close()
+			s.current = nil
+			if err != nil {
+				return RealmInput{}, err
+			}
+		}
+
+		if len(s.args) == 0 {
+			return RealmInput{}, io.EOF
+		}
+
+		arg := s.args[0]
+		s.args = s.args[1:]
+
+		var err error
+		s.current, err = openSource(arg, s.filter)
+		if err != nil {
+			return RealmInput{}, err
+		}
+	}
+}
+
+func (s *multiSource) Close() error {
+	if s.current != nil {
+		return s.current.Close()
+	}
+	return nil
+}
+
+// openSource returns the source of an argument
+func openSource(arg string, filter InputFilter) (InputSource, error) {
+	if arg == StdinInput {
+		return newStreamSource(arg, os.Stdin, nil, filter)
+	}
+
+	info, err := os.Stat(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return newDirSource(arg, filter)
+	}
+
+	f, err := OpenRealmFile(arg)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamSource(arg, f, f, filter)
+}
+
+// Offset and value of the magic bytes of tar archives
+const tarMagicOffset = 257
+
+var tarMagic = []byte("ustar")
+
+// isArchive tells whether the (decompressed) content is a tar archive
+func isArchive(r *bufio.Reader) bool {
+	header, _ := r.Peek(tarMagicOffset + len(tarMagic))
+	return len(header) == tarMagicOffset+len(tarMagic) && bytes.Equal(header[tarMagicOffset:], tarMagic)
+}
+
+// newStreamSource returns a source of one realm file, or of the files of
+// the tar archive
+func newStreamSource(name string, r io.Reader, closer io.Closer, filter InputFilter) (InputSource, error) {
+	decompressed, err := NewRealmReader(r)
+	if err != nil {
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, fmt.Errorf("Cannot decompress %s: %s", name, err)
+	}
+
+	buffered := bufio.NewReader(decompressed)
+	if isArchive(buffered) {
+		return &archiveSource{name: name, archive: tar.NewReader(buffered), closer: closer, filter: filter}, nil
+	}
+
+	return &fileSource{input: RealmInput{Name: name, Reader: buffered}, closer: closer}, nil
+}
+
+// fileSource is a single realm file
+type fileSource struct {
+	input  RealmInput
+	done   bool
+	closer io.Closer
+}
+
+func (s *fileSource) Next() (RealmInput, error) {
+	if s.done {
+		return RealmInput{}, io.EOF
+	}
+	s.done = true
+	return s.input, nil
+}
+
+func (s *fileSource) Close() error {
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+// archiveSource lists the realm files of a tar archive, as it is read
+type archiveSource struct {
+	name    string
+	archive *tar.Reader
+	closer  io.Closer
+	filter  InputFilter
+}
+
+func (s *archiveSource) Next() (RealmInput, error) {
+	for {
+		header, err := s.archive.Next()
+		if err == io.EOF {
+			return RealmInput{}, io.EOF
+		}
+		if err != nil {
+			return RealmInput{}, fmt.Errorf("Cannot read archive %s: %s", s.name, err)
+		}
+
+		// Archives are not read recursively
+		if header.Typeflag != tar.TypeReg || isArchiveName(header.Name) || !s.filter.Match(header.Name) {
+			continue
+		}
+
+		// Entries can be compressed too
+		name := path.Join(s.name, header.Name)
+		r, err := NewRealmReader(s.archive)
+		if err != nil {
+			return RealmInput{}, fmt.Errorf("Cannot decompress %s: %s", name, err)
+		}
+		return RealmInput{Name: name, Reader: r}, nil
+	}
+}
+
+func (s *archiveSource) Close() error {
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+// newDirSource lists the realm files of a directory and its sub-directories,
+// in lexical order. The archives of the directory are read as well.
+func newDirSource(dir string, filter InputFilter) (InputSource, error) {
+	var files []string
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relative, _ := filepath.Rel(dir, file)
+		if !info.Mode().IsRegular() || filter.matchExcludes(relative) {
+			return nil
+		}
+		if isArchiveName(relative) || filter.Match(relative) {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &multiSource{args: files, filter: filter}, nil
+}
+
+// Extensions of tar archives
+var archiveExtensions = []string{".tar", ".tar" + GzipExtension, ".tgz"}
+
+func isArchiveName(name string) bool {
+	for _, extension := range archiveExtensions {
+		if strings.HasSuffix(name, extension) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,478 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+
+	keycloak "github.com/nmasse-itix/keycloak-client"
+)
+
+// Layouts of the generated files
+const (
+	// One realm-<ID>.json file per realm
+	SingleFileLayout = "single-file"
+	// The layout of "kc.sh export --dir": <realm>-realm.json and
+	// <realm>-users-<n>.json files
+	KeycloakDirLayout = "keycloak-dir"
+)
+
+// Formats of the generated files, written by the template
+const (
+	JSONFormat = "json"
+	YAMLFormat = "yaml"
+)
+
+// Number of users per file of "kc.sh export --dir"
+const DefaultUsersPerFile = 50
+
+// Suffix of the files of a realm being written
+const partialSuffix = ".partial"
+
+// realmFiles are the files of a realm, written under a temporary name until
+// the realm has been rendered and validated, so that no invalid or truncated
+// realm is left behind.
+type realmFiles []string
+
+func (files *realmFiles) create(filename string, compress bool) (io.WriteCloser, error) {
+	f, err := CreateRealmFile(filename+partialSuffix, compress)
+	if err != nil {
+		return nil, err
+	}
+	*files = append(*files, filename)
+	return f, nil
+}
+
+// commit gives the files their final name
+func (files realmFiles) commit() error {
+	for _, filename := range files {
+		err := os.Rename(filename+partialSuffix, filename)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discard removes the files not yet committed
+func (files realmFiles) discard() {
+	for _, filename := range files {
+		os.Remove(filename + partialSuffix)
+	}
+}
+
+// WriteRealmFileAs renders the realm in filename, gzip-compressed when
+// requested. The file only appears once the realm is valid.
+func WriteRealmFileAs(realm GeneratedRealm, filename string, compress bool) error {
+	var files realmFiles
+	f, err := files.create(filename, compress)
+	if err != nil {
+		return err
+	}
+
+	err = WriteRealmFile(realm, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = files.commit()
+	}
+	if err != nil {
+		files.discard()
+	}
+	return err
+}
+
+// UsersFile is the content of a <realm>-users-<n>.json file
+type UsersFile struct {
+	Realm string                        `json:"realm"`
+	Users []keycloak.UserRepresentation `json:"users"`
+}
+
+// WriteRealmDir renders the realm and writes it in the target directory, in
+// the layout of "kc.sh export --dir": the realm without its users in
+// <realm>-realm.json and the users, by chunks of usersPerFile, in
+// <realm>-users-<n>.json. The users are written as they are rendered, but
+// the files only appear once the realm is valid. With compress, the files
+// are gzip-compressed (.json.gz).
+func WriteRealmDir(realm GeneratedRealm, targetDir string, usersPerFile int, compress bool) error {
+	if usersPerFile < 1 {
+		return fmt.Errorf("The number of users per file must be positive")
+	}
+
+	var files realmFiles
+	err := writeRealmDir(realm, targetDir, usersPerFile, compress, &files)
+	if err == nil {
+		err = files.commit()
+	}
+	if err != nil {
+		files.discard()
+	}
+	return err
+}
+
+func writeRealmDir(realm GeneratedRealm, targetDir string, usersPerFile int, compress bool, files *realmFiles) error {
+
+	pr, pw := io.Pipe()
+	rendering := make(chan error, 1)
+	go func() {
+		err := WriteRealmFile(realm, pw)
+		pw.CloseWithError(err)
+		rendering <- err
+	}()
+
+	users := &usersWriter{dir: targetDir, perFile: usersPerFile, compress: compress, files: files}
+	realmOnly, err := splitRealm(pr, users)
+	if err == nil {
+		err = users.Close()
+	} else {
+		users.Close()
+	}
+	if err != nil {
+		// The rendering error, if any, tells where the template is wrong
+		io.Copy(ioutil.Discard, pr)
+		if renderErr := <-rendering; renderErr != nil {
+			return renderErr
+		}
+		return fmt.Errorf("Cannot split realm %s: %s", realm.ID, err)
+	}
+
+	err = <-rendering
+	if err != nil {
+		return err
+	}
+
+	return writeIndentedFile(files, path.Join(targetDir, users.name+"-realm"+jsonExtension(compress)), realmOnly, compress)
+}
+
+// splitRealm reads a realm, sends its users to the usersWriter and returns
+// the rest of the realm.
+func splitRealm(r io.Reader, users *usersWriter) ([]byte, error) {
+	decoder := json.NewDecoder(r)
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return nil, fmt.Errorf("expected a JSON object")
+	}
+
+	var realmOnly bytes.Buffer
+	realmOnly.WriteString("{")
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := token.(string)
+
+		if key == "users" {
+			err = splitUsers(decoder, users)
+			if err != nil {
+				return nil, fmt.Errorf("users: %s", err)
+			}
+			continue
+		}
+
+		var value json.RawMessage
+		err = decoder.Decode(&value)
+		if err != nil {
+			return nil, err
+		}
+
+		if key == "realm" {
+			var name string
+			err = json.Unmarshal(value, &name)
+			if err != nil {
+				return nil, fmt.Errorf("realm: %s", err)
+			}
+			err = users.SetName(name)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if realmOnly.Len() > 1 {
+			realmOnly.WriteString(",")
+		}
+		name, _ := json.Marshal(key)
+		realmOnly.Write(name)
+		realmOnly.WriteString(":")
+		realmOnly.Write(value)
+	}
+	realmOnly.WriteString("}")
+
+	_, err = decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	_, err = decoder.Token()
+	if err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the JSON object")
+	}
+
+	if users.name == "" {
+		return nil, fmt.Errorf("the rendered realm has no name")
+	}
+
+	return realmOnly.Bytes(), nil
+}
+
+// splitUsers sends the users of the list to the usersWriter, one at a time
+func splitUsers(decoder *json.Decoder, users *usersWriter) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected a list")
+	}
+
+	for decoder.More() {
+		var user json.RawMessage
+		err = decoder.Decode(&user)
+		if err != nil {
+			return err
+		}
+		err = users.Write(user)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = decoder.Token()
+	return err
+}
+
+// usersWriter writes the users of a realm in <realm>-users-<n>.json files.
+// The users coming before the realm name are kept until it is known.
+type usersWriter struct {
+	dir      string
+	name     string
+	perFile  int
+	compress bool
+	pending  []json.RawMessage
+	count    int
+	out      io.WriteCloser
+	files    *realmFiles
+}
+
+// SetName sets the realm name and writes the pending users
+func (w *usersWriter) SetName(name string) error {
+	if w.name != "" {
+		return fmt.Errorf("the realm has several names")
+	}
+	w.name = name
+
+	for _, user := range w.pending {
+		err := w.Write(user)
+		if err != nil {
+			return err
+		}
+	}
+	w.pending = nil
+	return nil
+}
+
+// Write writes a user, in a new file every perFile users
+func (w *usersWriter) Write(user json.RawMessage) error {
+	if w.name == "" {
+		w.pending = append(w.pending, user)
+		return nil
+	}
+
+	if w.count%w.perFile == 0 {
+		err := w.Close()
+		if err != nil {
+			return err
+		}
+
+		filename := fmt.Sprintf("%s-users-%d%s", w.name, w.count/w.perFile, jsonExtension(w.compress))
+		w.out, err = w.files.create(path.Join(w.dir, filename), w.compress)
+		if err != nil {
+			return err
+		}
+
+		name, _ := json.Marshal(w.name)
+		fmt.Fprintf(w.out, "{\n  \"realm\": %s,\n  \"users\": [\n    ", name)
+	} else {
+		io.WriteString(w.out, ",\n    ")
+	}
+	w.count++
+
+	var indented bytes.Buffer
+	err := json.Indent(&indented, user, "    ", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = indented.WriteTo(w.out)
+	return err
+}
+
+// Close ends the current file, if any
+func (w *usersWriter) Close() error {
+	if w.out == nil {
+		return nil
+	}
+
+	io.WriteString(w.out, "\n  ]\n}\n")
+	err := w.out.Close()
+	w.out = nil
+	return err
+}
+
+func writeIndentedFile(files *realmFiles, filename string, content []byte, compress bool) error {
+	f, err := files.create(filename, compress)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	err = json.Indent(&out, content, "", "  ")
+	if err == nil {
+		out.WriteString("\n")
+		_, err = out.WriteTo(f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// jsonExtension returns the extension of JSON files, compressed or not
+func jsonExtension(compress bool) string {
+	if compress {
+		return ".json" + GzipExtension
+	}
+	return ".json"
+}
+
+// Files of the layout of "kc.sh export --dir"
+var (
+	realmFilePattern = regexp.MustCompile(`^(.+)-realm\.json(\.gz)?$`)
+	usersFilePattern = regexp.MustCompile(`^(.+)-users-([0-9]+)\.json(\.gz)?$`)
+)
+
+// ParseRealmFileName returns the realm of the files of the layout of
+// "kc.sh export --dir", as well as the chunk number of <realm>-users-<n>.json
+// files (-1 for <realm>-realm.json). The realm of standalone realm files is
+// empty.
+func ParseRealmFileName(name string) (string, int) {
+	base := path.Base(filepath.ToSlash(name))
+	if m := usersFilePattern.FindStringSubmatch(base); m != nil {
+		chunk, _ := strconv.Atoi(m[2])
+		return m[1], chunk
+	}
+	if m := realmFilePattern.FindStringSubmatch(base); m != nil {
+		return m[1], -1
+	}
+	return "", -1
+}
+
+// usersChunkInput is a <realm>-users-<n>.json file read before its realm file
+type usersChunkInput struct {
+	name    string
+	chunk   int
+	content []byte
+}
+
+// WalkRealmFiles reads the realm files of the source and calls realmFile for
+// each realm file, then usersFile for each <realm>-users-<n>.json file of
+// the layout of "kc.sh export --dir". The users files are always processed
+// after their realm file: the ones that come first are kept in memory until
+// their realm file comes.
+func WalkRealmFiles(source InputSource, realmFile func(input RealmInput) error, usersFile func(realm string, input RealmInput) error) error {
+	realmFiles := make(map[string]string)
+	pending := make(map[string][]usersChunkInput)
+	var pendingRealms []string
+
+	for {
+		input, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		realm, chunk := ParseRealmFileName(input.Name)
+		switch {
+		case realm == "":
+			err = realmFile(input)
+		case chunk >= 0 && realmFiles[realm] == "":
+			content, err := ioutil.ReadAll(input)
+			if err != nil {
+				return fmt.Errorf("Cannot read %s: %s", input.Name, err)
+			}
+			if _, ok := pending[realm]; !ok {
+				pendingRealms = append(pendingRealms, realm)
+			}
+			pending[realm] = append(pending[realm], usersChunkInput{input.Name, chunk, content})
+		case chunk >= 0:
+			err = usersFile(realm, input)
+		default:
+			if realmFiles[realm] != "" {
+				return fmt.Errorf("Realm %s is defined by both %s and %s", realm, realmFiles[realm], input.Name)
+			}
+			realmFiles[realm] = input.Name
+
+			err = realmFile(input)
+			if err != nil {
+				return err
+			}
+
+			// users-10 comes after users-9
+			chunks := pending[realm]
+			delete(pending, realm)
+			sort.SliceStable(chunks, func(i, j int) bool {
+				return chunks[i].chunk < chunks[j].chunk
+			})
+			for _, c := range chunks {
+				err = usersFile(realm, RealmInput{Name: c.name, Reader: bytes.NewReader(c.content)})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, realm := range pendingRealms {
+		if chunks, ok := pending[realm]; ok {
+			return fmt.Errorf("Missing %s-realm.json for %s", realm, chunks[0].name)
+		}
+	}
+
+	return nil
+}
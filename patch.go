@@ -0,0 +1,611 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Fields identifying the items of the lists of a realm, in patches
+var realmListKeys = map[string]string{
+	"clients": "clientId",
+	"users":   "username",
+}
+
+// RealmPatch is a JSON Patch (RFC 6902) or a JSON Merge Patch (RFC 7386),
+// applied to realm files at import time.
+//
+// Clients and users can be targeted by their clientId and username: in JSON
+// Patches, with the clientId=<id> and username=<name> path segments (such as
+// /clients/clientId=app1/redirectUris/-) and in Merge Patches, by giving the
+// clients and users as objects keyed by clientId and username.
+type RealmPatch struct {
+	Name       string
+	operations []patchOperation
+	merge      map[string]interface{}
+}
+
+// patchOperation is an operation of a JSON Patch
+type patchOperation struct {
+	Op    string
+	Path  []string
+	From  []string
+	Value interface{}
+}
+
+// LoadRealmPatch reads a patch file, in JSON or in YAML. Lists are JSON
+// Patches and objects are JSON Merge Patches.
+func LoadRealmPatch(filename string) (RealmPatch, error) {
+	f, err := OpenRealmFile(filename)
+	if err != nil {
+		return RealmPatch{Name: filename}, err
+	}
+	defer f.Close()
+
+	var content interface{}
+	err = DecodeRealmFile(RealmInput{Name: filename, Reader: f}, &content)
+	if err != nil {
+		return RealmPatch{Name: filename}, err
+	}
+
+	return parseRealmPatch(filename, content)
+}
+
+// parseRealmPatch builds a patch from its content, decoded as generic JSON
+// values
+func parseRealmPatch(filename string, content interface{}) (RealmPatch, error) {
+	patch := RealmPatch{Name: filename}
+
+	switch document := content.(type) {
+	case map[string]interface{}:
+		patch.merge = document
+	case []interface{}:
+		for i, item := range document {
+			operation, err := parsePatchOperation(item)
+			if err != nil {
+				return patch, fmt.Errorf("Invalid patch %s: operation %d: %s", filename, i, err)
+			}
+			patch.operations = append(patch.operations, operation)
+		}
+	default:
+		return patch, fmt.Errorf("Invalid patch %s: expected a list of operations (JSON Patch) or an object (JSON Merge Patch)", filename)
+	}
+
+	return patch, nil
+}
+
+func parsePatchOperation(item interface{}) (patchOperation, error) {
+	var operation patchOperation
+
+	fields, ok := item.(map[string]interface{})
+	if !ok {
+		return operation, fmt.Errorf("expected an object")
+	}
+
+	operation.Op, _ = fields["op"].(string)
+	path, ok := fields["path"].(string)
+	if !ok {
+		return operation, fmt.Errorf("missing path")
+	}
+
+	var err error
+	operation.Path, err = parsePointer(path)
+	if err != nil {
+		return operation, err
+	}
+
+	switch operation.Op {
+	case "add", "replace", "test":
+		var ok bool
+		operation.Value, ok = fields["value"]
+		if !ok {
+			return operation, fmt.Errorf("missing value")
+		}
+	case "move", "copy":
+		from, ok := fields["from"].(string)
+		if !ok {
+			return operation, fmt.Errorf("missing from")
+		}
+		operation.From, err = parsePointer(from)
+		if err != nil {
+			return operation, err
+		}
+	case "remove":
+	default:
+		return operation, fmt.Errorf("unknown operation '%s'", operation.Op)
+	}
+
+	return operation, nil
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) in unescaped tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid path '%s' (paths start with /)", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+func formatPointer(tokens []string) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteString("/")
+		b.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(token))
+	}
+	return b.String()
+}
+
+// Parts of a realm a patch is applied to. In the layout of "kc.sh export
+// --dir", the users are in <realm>-users-<n>.json files rather than in the
+// realm file.
+type patchTarget int
+
+const (
+	// A realm with its users
+	wholeRealm patchTarget = iota
+	// A <realm>-realm.json file, whose users are in users files
+	realmWithoutUsers
+	// A <realm>-users-<n>.json file
+	usersChunk
+)
+
+// Apply applies the patch to a realm, decoded as generic JSON values
+func (patch RealmPatch) Apply(realm interface{}) (interface{}, error) {
+	return patch.apply(realm, wholeRealm)
+}
+
+// apply applies the patch to a part of a realm. The operations on the users
+// only apply to the users files, which patch the users they have (the users
+// are selected by username=<name> in JSON Patches).
+func (patch RealmPatch) apply(document interface{}, target patchTarget) (interface{}, error) {
+	if patch.merge != nil {
+		merge, err := patch.mergeFor(document, target)
+		if err != nil {
+			return nil, err
+		}
+		return mergePatch(document, merge, true), nil
+	}
+
+	for i, operation := range patch.operations {
+		skipped, err := operation.skipped(document, target)
+		if err == nil && !skipped {
+			document, err = operation.apply(document)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %s", i, operation.Op, formatPointer(operation.Path), err)
+		}
+	}
+	return document, nil
+}
+
+// mergeFor returns the part of the Merge Patch that applies to the target:
+// the users in a users file (when the users file has them), the rest of the
+// realm in a realm file without users.
+func (patch RealmPatch) mergeFor(document interface{}, target patchTarget) (map[string]interface{}, error) {
+	switch target {
+	case realmWithoutUsers:
+		merge := make(map[string]interface{}, len(patch.merge))
+		for key, value := range patch.merge {
+			if key != "users" {
+				merge[key] = value
+			}
+		}
+		return merge, nil
+	case usersChunk:
+		value, ok := patch.merge["users"]
+		if !ok {
+			return map[string]interface{}{}, nil
+		}
+		items, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("users have to be given by username in directory exports")
+		}
+
+		users, _ := getValue(document, []string{"users"})
+		list, _ := users.([]interface{})
+		mine := make(map[string]interface{})
+		for username, item := range items {
+			if _, err := listIndex(list, realmListKeys["users"]+"="+username, false); err == nil {
+				mine[username] = item
+			}
+		}
+		return map[string]interface{}{"users": mine}, nil
+	}
+	return patch.merge, nil
+}
+
+// skipped tells whether an operation of a JSON Patch applies to another part
+// of the realm than the target
+func (operation patchOperation) skipped(document interface{}, target patchTarget) (bool, error) {
+	if target == wholeRealm {
+		return false, nil
+	}
+
+	onUsers := isUsersPath(operation.Path)
+	if operation.From != nil && isUsersPath(operation.From) != onUsers {
+		return false, fmt.Errorf("cannot move values between users and the realm in directory exports")
+	}
+	switch {
+	case target == realmWithoutUsers:
+		return onUsers, nil
+	case !onUsers:
+		return true, nil
+	}
+
+	// Users files only patch the users they have
+	users, _ := getValue(document, []string{"users"})
+	list, _ := users.([]interface{})
+	for _, path := range [][]string{operation.Path, operation.From} {
+		if path == nil {
+			continue
+		}
+		if len(path) < 2 || !strings.Contains(path[1], "=") {
+			return false, fmt.Errorf("users have to be selected by username=<name> in directory exports")
+		}
+		if _, err := listIndex(list, path[1], false); err != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func isUsersPath(path []string) bool {
+	return len(path) > 0 && path[0] == "users"
+}
+
+func (operation patchOperation) apply(document interface{}) (interface{}, error) {
+	switch operation.Op {
+	case "add":
+		return addValue(document, operation.Path, copyValue(operation.Value))
+	case "remove":
+		document, _, err := removeValue(document, operation.Path)
+		return document, err
+	case "replace":
+		return replaceValue(document, operation.Path, copyValue(operation.Value))
+	case "move":
+		document, value, err := removeValue(document, operation.From)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(document, operation.Path, value)
+	case "copy":
+		value, err := getValue(document, operation.From)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(document, operation.Path, copyValue(value))
+	case "test":
+		value, err := getValue(document, operation.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(value, operation.Value) {
+			return nil, fmt.Errorf("test failed")
+		}
+		return document, nil
+	}
+	return nil, fmt.Errorf("unknown operation '%s'", operation.Op)
+}
+
+// listIndex resolves a token in a list: an index, "-" (the end of the
+// list, when allowed) or a <field>=<value> selector.
+func listIndex(list []interface{}, token string, end bool) (int, error) {
+	if token == "-" && end {
+		return len(list), nil
+	}
+
+	if i := strings.Index(token, "="); i > 0 {
+		field, value := token[:i], token[i+1:]
+		for j, item := range list {
+			if object, ok := item.(map[string]interface{}); ok && object[field] == value {
+				return j, nil
+			}
+		}
+		return 0, fmt.Errorf("no item with %s", token)
+	}
+
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid list index '%s'", token)
+	}
+	if index > len(list) || (index == len(list) && !end) {
+		return 0, fmt.Errorf("list index %d out of range", index)
+	}
+	return index, nil
+}
+
+func getValue(document interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := document.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("no member '%s'", token)
+			}
+			document = value
+		case []interface{}:
+			i, err := listIndex(node, token, false)
+			if err != nil {
+				return nil, err
+			}
+			document = node[i]
+		default:
+			return nil, fmt.Errorf("cannot find '%s' in a scalar value", token)
+		}
+	}
+	return document, nil
+}
+
+// updateParent calls update with the parent of the target of the path and
+// the last token, and returns the updated document.
+func updateParent(document interface{}, path []string, update func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return update(document, path[0])
+	}
+
+	// The index is resolved before the update, which may change the
+	// selected item
+	switch node := document.(type) {
+	case map[string]interface{}:
+		child, ok := node[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("no member '%s'", path[0])
+		}
+		child, err := updateParent(child, path[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		node[path[0]] = child
+		return node, nil
+	case []interface{}:
+		i, err := listIndex(node, path[0], false)
+		if err != nil {
+			return nil, err
+		}
+		child, err := updateParent(node[i], path[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = child
+		return node, nil
+	}
+	return nil, fmt.Errorf("cannot find '%s' in a scalar value", path[0])
+}
+
+func addValue(document interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return updateParent(document, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			i, err := listIndex(node, token, true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("cannot add '%s' to a scalar value", token)
+	})
+}
+
+// replaceValue replaces an existing value in place, so that the selectors
+// of the path still match when the value changes
+func replaceValue(document interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return updateParent(document, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := node[token]; !ok {
+				return nil, fmt.Errorf("no member '%s'", token)
+			}
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			i, err := listIndex(node, token, false)
+			if err != nil {
+				return nil, err
+			}
+			node[i] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("cannot replace '%s' in a scalar value", token)
+	})
+}
+
+func removeValue(document interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("cannot remove the whole realm")
+	}
+
+	var removed interface{}
+	document, err := updateParent(document, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("no member '%s'", token)
+			}
+			removed = value
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			i, err := listIndex(node, token, false)
+			if err != nil {
+				return nil, err
+			}
+			removed = node[i]
+			return append(node[:i], node[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove '%s' from a scalar value", token)
+	})
+	return document, removed, err
+}
+
+// copyValue returns a deep copy of a value, so that patch values are not
+// shared between realms
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			c[key] = copyValue(item)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, item := range v {
+			c[i] = copyValue(item)
+		}
+		return c
+	}
+	return value
+}
+
+// mergePatch applies a JSON Merge Patch. At the root of the realm, the
+// clients and users can be patched individually (see RealmPatch).
+func mergePatch(target, patch interface{}, root bool) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return copyValue(patch)
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+
+		field, keyed := realmListKeys[key]
+		items, isObject := value.(map[string]interface{})
+		if root && keyed && isObject {
+			list, _ := targetObject[key].([]interface{})
+			targetObject[key] = mergeList(list, items, field)
+			continue
+		}
+
+		targetObject[key] = mergePatch(targetObject[key], value, false)
+	}
+	return targetObject
+}
+
+// mergeList patches the items of a list, identified by one of their fields.
+// Unknown items are added, null items are removed.
+func mergeList(list []interface{}, items map[string]interface{}, field string) []interface{} {
+	ids := make([]string, 0, len(items))
+	for id := range items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		i, err := listIndex(list, field+"="+id, false)
+		switch {
+		case err != nil && items[id] == nil:
+		case err != nil:
+			item := mergePatch(map[string]interface{}{field: id}, items[id], false)
+			list = append(list, item)
+		case items[id] == nil:
+			list = append(list[:i], list[i+1:]...)
+		default:
+			list[i] = mergePatch(list[i], items[id], false)
+		}
+	}
+	return list
+}
+
+// DecodePatchedRealmFile decodes a realm file, as DecodeRealmFile does,
+// after applying the patches in order. The users of the directory exports
+// are patched in their <realm>-users-<n>.json files.
+func DecodePatchedRealmFile(input RealmInput, patches []RealmPatch, v interface{}) error {
+	if len(patches) == 0 {
+		return DecodeRealmFile(input, v)
+	}
+
+	realm, err := decodePatchedRealm(input, patches)
+	if err != nil {
+		return err
+	}
+	return convertRealm(input.Name+" once patched", realm, v)
+}
+
+// decodePatchedRealm decodes a realm file (or a <realm>-users-<n>.json file)
+// as generic JSON values and applies the patches
+func decodePatchedRealm(input RealmInput, patches []RealmPatch) (interface{}, error) {
+	var realm interface{}
+	err := DecodeRealmFile(input, &realm)
+	if err != nil {
+		return nil, err
+	}
+
+	target := wholeRealm
+	if name, chunk := ParseRealmFileName(input.Name); chunk >= 0 {
+		target = usersChunk
+	} else if root, ok := realm.(map[string]interface{}); ok && name != "" && root["users"] == nil {
+		target = realmWithoutUsers
+	}
+
+	for _, patch := range patches {
+		realm, err = patch.apply(realm, target)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot apply patch %s to %s: %s", patch.Name, input.Name, err)
+		}
+	}
+	return realm, nil
+}
+
+// convertRealm decodes a realm, given as generic JSON values, into v
+func convertRealm(name string, realm interface{}, v interface{}) error {
+	content, err := json.Marshal(realm)
+	if err == nil {
+		err = json.Unmarshal(content, v)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot decode %s: %s", name, err)
+	}
+	return nil
+}
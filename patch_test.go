@@ -0,0 +1,226 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testRealm = `{
+  "realm": "acme",
+  "clients": [
+    { "clientId": "app1", "redirectUris": [ "http://a" ] },
+    { "clientId": "app2", "redirectUris": [ "http://b" ] }
+  ],
+  "users": [
+    { "username": "alice", "email": "alice@acme" },
+    { "username": "bob", "email": "bob@acme" }
+  ]
+}`
+
+func decodeTestJSON(t *testing.T, content string) interface{} {
+	t.Helper()
+	var v interface{}
+	err := json.Unmarshal([]byte(content), &v)
+	if err != nil {
+		t.Fatalf("invalid test JSON %s: %s", content, err)
+	}
+	return v
+}
+
+func applyTestPatch(t *testing.T, document, patch string) (interface{}, error) {
+	t.Helper()
+	p, err := parseRealmPatch("test", decodeTestJSON(t, patch))
+	if err != nil {
+		return nil, err
+	}
+	return p.Apply(decodeTestJSON(t, document))
+}
+
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		name, document, patch, expected string
+	}{
+		// Examples of RFC 6902, appendix A
+		{"add member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{"add item", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{"remove member", `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{"remove item", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{"replace", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{"move member", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{"move item", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{"test", `{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{"add nested", `{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`},
+		{"escapes", `{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10},{"op":"remove","path":"/~1"}]`, `{"~1":10}`},
+		{"append", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{"copy", `{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"replace","path":"/baz/bar","value":2}]`, `{"foo":{"bar":1},"baz":{"bar":2}}`},
+		{"replace root", `{"foo":1}`, `[{"op":"replace","path":"","value":{"bar":2}}]`, `{"bar":2}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := applyTestPatch(t, test.document, test.patch)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if expected := decodeTestJSON(t, test.expected); !reflect.DeepEqual(result, expected) {
+				t.Errorf("got %v, expected %v", result, expected)
+			}
+		})
+	}
+}
+
+func TestJSONPatchSelectors(t *testing.T) {
+	tests := []struct {
+		name, patch, path, expected string
+	}{
+		{"append to a client", `[{"op":"add","path":"/clients/clientId=app2/redirectUris/-","value":"http://c"}]`, "/clients/1/redirectUris", `["http://b","http://c"]`},
+		{"replace a user field", `[{"op":"replace","path":"/users/username=bob/email","value":"bob@prod"}]`, "/users/1", `{"username":"bob","email":"bob@prod"}`},
+		{"replace a user", `[{"op":"replace","path":"/users/username=bob","value":{"username":"bob"}}]`, "/users", `[{"username":"alice","email":"alice@acme"},{"username":"bob"}]`},
+		{"replace the selected field", `[{"op":"replace","path":"/clients/clientId=app2/clientId","value":"app3"}]`, "/clients/1/clientId", `"app3"`},
+		{"remove the selected field", `[{"op":"remove","path":"/clients/clientId=app2/clientId"}]`, "/clients", `[{"clientId":"app1","redirectUris":["http://a"]},{"redirectUris":["http://b"]}]`},
+		{"remove a client", `[{"op":"remove","path":"/clients/clientId=app1"}]`, "/clients", `[{"clientId":"app2","redirectUris":["http://b"]}]`},
+		{"test a user", `[{"op":"test","path":"/users/username=alice/email","value":"alice@acme"}]`, "/users/0/email", `"alice@acme"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := applyTestPatch(t, testRealm, test.patch)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			path, _ := parsePointer(test.path)
+			value, err := getValue(result, path)
+			if err != nil {
+				t.Fatalf("cannot get %s: %s", test.path, err)
+			}
+			if expected := decodeTestJSON(t, test.expected); !reflect.DeepEqual(value, expected) {
+				t.Errorf("got %v at %s, expected %v", value, test.path, expected)
+			}
+		})
+	}
+}
+
+func TestJSONPatchErrors(t *testing.T) {
+	tests := []struct {
+		name, patch, err string
+	}{
+		{"unknown selector", `[{"op":"replace","path":"/clients/clientId=nope/enabled","value":true}]`, "no item with clientId=nope"},
+		{"replace a missing member", `[{"op":"replace","path":"/users/username=bob/firstName","value":"Bob"}]`, "no member 'firstName'"},
+		{"index out of range", `[{"op":"remove","path":"/clients/7"}]`, "list index 7 out of range"},
+		{"invalid index", `[{"op":"add","path":"/clients/01","value":{}}]`, "invalid list index '01'"},
+		{"failed test", `[{"op":"test","path":"/realm","value":"other"}]`, "test failed"},
+		{"remove the realm", `[{"op":"remove","path":""}]`, "cannot remove the whole realm"},
+		{"scalar", `[{"op":"add","path":"/realm/name","value":"x"}]`, "cannot add 'name' to a scalar value"},
+		{"unknown operation", `[{"op":"frob","path":"/realm"}]`, "unknown operation 'frob'"},
+		{"missing value", `[{"op":"add","path":"/realm"}]`, "missing value"},
+		{"invalid path", `[{"op":"remove","path":"realm"}]`, "paths start with /"},
+		{"invalid patch", `"realm"`, "expected a list of operations"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := applyTestPatch(t, testRealm, test.patch)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name, document, patch, expected string
+	}{
+		// Examples of RFC 7386, appendix A
+		{"replace", `{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{"add", `{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{"remove", `{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{"list", `{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{"nested", `{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{"nested null", `{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		// Clients and users keyed by clientId and username
+		{"keyed", testRealm, `{"clients":{"app1":{"redirectUris":["https://a"]},"app2":null,"app3":{"publicClient":true}},"users":{"bob":{"email":"bob@prod"}}}`,
+			`{"realm":"acme","clients":[{"clientId":"app1","redirectUris":["https://a"]},{"clientId":"app3","publicClient":true}],"users":[{"username":"alice","email":"alice@acme"},{"username":"bob","email":"bob@prod"}]}`},
+		{"keyed list replaced", testRealm, `{"clients":[],"users":null}`, `{"realm":"acme","clients":[]}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := applyTestPatch(t, test.document, test.patch)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if expected := decodeTestJSON(t, test.expected); !reflect.DeepEqual(result, expected) {
+				t.Errorf("got %v, expected %v", result, expected)
+			}
+		})
+	}
+}
+
+func TestPatchDirectoryExport(t *testing.T) {
+	files := []struct{ name, content string }{
+		{"acme-realm.json", `{"realm":"acme","clients":[{"clientId":"app1"}]}`},
+		{"acme-users-0.json", `{"realm":"acme","users":[{"username":"alice","email":"alice@acme"}]}`},
+		{"acme-users-1.json", `{"realm":"acme","users":[{"username":"bob","email":"bob@acme"}]}`},
+	}
+
+	tests := []struct {
+		name, patch string
+		expected    []string
+	}{
+		{"json patch", `[{"op":"replace","path":"/users/username=bob/email","value":"bob@prod"},{"op":"add","path":"/clients/clientId=app1/enabled","value":false}]`, []string{
+			`{"realm":"acme","clients":[{"clientId":"app1","enabled":false}]}`,
+			`{"realm":"acme","users":[{"username":"alice","email":"alice@acme"}]}`,
+			`{"realm":"acme","users":[{"username":"bob","email":"bob@prod"}]}`,
+		}},
+		{"merge patch", `{"enabled":true,"users":{"alice":{"email":"alice@prod"},"carol":{"email":"carol@prod"}}}`, []string{
+			`{"realm":"acme","enabled":true,"clients":[{"clientId":"app1"}]}`,
+			`{"realm":"acme","users":[{"username":"alice","email":"alice@prod"}]}`,
+			`{"realm":"acme","users":[{"username":"bob","email":"bob@acme"}]}`,
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patch, err := parseRealmPatch("test", decodeTestJSON(t, test.patch))
+			if err != nil {
+				t.Fatalf("invalid patch: %s", err)
+			}
+			for i, file := range files {
+				result, err := decodePatchedRealm(RealmInput{Name: file.name, Reader: strings.NewReader(file.content)}, []RealmPatch{patch})
+				if err != nil {
+					t.Fatalf("%s: unexpected error: %s", file.name, err)
+				}
+				if expected := decodeTestJSON(t, test.expected[i]); !reflect.DeepEqual(result, expected) {
+					t.Errorf("%s: got %v, expected %v", file.name, result, expected)
+				}
+			}
+		})
+	}
+
+	patch, _ := parseRealmPatch("test", decodeTestJSON(t, `[{"op":"remove","path":"/users/0"}]`))
+	_, err := decodePatchedRealm(RealmInput{Name: files[1].name, Reader: strings.NewReader(files[1].content)}, []RealmPatch{patch})
+	if err == nil || !strings.Contains(err.Error(), "selected by username=<name>") {
+		t.Errorf("got error %v, expected users to be selected by username", err)
+	}
+}
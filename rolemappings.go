@@ -0,0 +1,250 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	keycloak "github.com/nmasse-itix/keycloak-client"
+)
+
+// Keycloak creates clients and users without their roles: the client roles
+// are created once the client exists and the roles of a user are granted
+// through the role mappings endpoints once the user exists.
+
+// roleReference identifies a role in role mappings
+type roleReference struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// adminRequest sends a request to the admin API of the realm and decodes the
+// JSON response in response, when not nil.
+func (importer *KeycloakImporter) adminRequest(method string, path []string, query url.Values, body, response interface{}) error {
+	segments := make([]string, len(path))
+	for i, segment := range path {
+		segments[i] = url.PathEscape(segment)
+	}
+	target := importer.adminURL + strings.Join(segments, "/")
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	var content io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		content = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, target, content)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+importer.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := importer.httpClient.Do(req)
+	if err != nil {
+		return &ImportError{Message: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return &ImportError{Message: err.Error()}
+	}
+	if resp.StatusCode >= 300 {
+		return &ImportError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+	}
+
+	if response != nil {
+		return json.Unmarshal(b, response)
+	}
+	return nil
+}
+
+// clientUUID returns the ID of a client, given its clientId
+func (importer *KeycloakImporter) clientUUID(realmName, clientID string) (string, error) {
+	key := realmName + "/" + clientID
+	if id, ok := importer.clientIDs[key]; ok {
+		return id, nil
+	}
+
+	var clients []struct {
+		ID       string `json:"id"`
+		ClientID string `json:"clientId"`
+	}
+	err := importer.adminRequest("GET", []string{realmName, "clients"}, url.Values{"clientId": {clientID}}, nil, &clients)
+	if err != nil {
+		return "", err
+	}
+
+	for _, client := range clients {
+		if client.ClientID == clientID {
+			importer.clientIDs[key] = client.ID
+			return client.ID, nil
+		}
+	}
+	return "", fmt.Errorf("Cannot find client %s in realm %s", clientID, realmName)
+}
+
+// userID returns the ID of a user, given its username
+func (importer *KeycloakImporter) userID(realmName, username string) (string, error) {
+	var users []struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	}
+	query := url.Values{"username": {username}, "exact": {"true"}}
+	err := importer.adminRequest("GET", []string{realmName, "users"}, query, nil, &users)
+	if err != nil {
+		return "", err
+	}
+
+	// Older Keycloak releases search usernames rather than matching them
+	for _, user := range users {
+		if strings.EqualFold(user.Username, username) {
+			return user.ID, nil
+		}
+	}
+	return "", fmt.Errorf("Cannot find user %s in realm %s", username, realmName)
+}
+
+// findRoles returns the references of the realm roles (when clientUUID is
+// empty) or of the client roles. The roles are listed once per realm or
+// client.
+func (importer *KeycloakImporter) findRoles(realmName, clientUUID string, names []string) ([]roleReference, error) {
+	key := realmName + "/" + clientUUID
+	path := []string{realmName, "roles"}
+	if clientUUID != "" {
+		path = []string{realmName, "clients", clientUUID, "roles"}
+	}
+
+	roles, ok := importer.roles[key]
+	if !ok {
+		var list []roleReference
+		err := importer.adminRequest("GET", path, nil, nil, &list)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = make(map[string]roleReference, len(list))
+		for _, role := range list {
+			roles[role.Name] = role
+		}
+		importer.roles[key] = roles
+	}
+
+	references := make([]roleReference, len(names))
+	for i, name := range names {
+		role, ok := roles[name]
+		if !ok {
+			return nil, fmt.Errorf("Cannot find role %s in realm %s", name, realmName)
+		}
+		references[i] = role
+	}
+	return references, nil
+}
+
+// ApplyClientRoles creates the roles of a client, once the client exists.
+// Existing roles are left as they are.
+func (importer *KeycloakImporter) ApplyClientRoles(realmName, clientID string, roles []keycloak.RoleRepresentation) error {
+	id, err := importer.clientUUID(realmName, clientID)
+	if err != nil {
+		return err
+	}
+
+	for _, role := range roles {
+		err := importer.adminRequest("POST", []string{realmName, "clients", id, "roles"}, nil, role, nil)
+		if e, ok := err.(*ImportError); ok && e.StatusCode == 409 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// The roles are listed again when users are granted them
+	delete(importer.roles, realmName+"/"+id)
+
+	return nil
+}
+
+// ApplyUserRoles grants its realm and client roles to a user, once the user
+// exists. The clients and their roles have to be created beforehand.
+func (importer *KeycloakImporter) ApplyUserRoles(realmName string, user keycloak.UserRepresentation) error {
+	hasRealmRoles := user.RealmRoles != nil && len(*user.RealmRoles) > 0
+	hasClientRoles := user.ClientRoles != nil && len(*user.ClientRoles) > 0
+	if !hasRealmRoles && !hasClientRoles {
+		return nil
+	}
+
+	id, err := importer.userID(realmName, *user.Username)
+	if err != nil {
+		return err
+	}
+
+	if hasRealmRoles {
+		roles, err := importer.findRoles(realmName, "", *user.RealmRoles)
+		if err != nil {
+			return err
+		}
+
+		err = importer.adminRequest("POST", []string{realmName, "users", id, "role-mappings", "realm"}, nil, roles, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if hasClientRoles {
+		for clientID, names := range *user.ClientRoles {
+			if len(names) == 0 {
+				continue
+			}
+
+			clientUUID, err := importer.clientUUID(realmName, clientID)
+			if err != nil {
+				return err
+			}
+
+			roles, err := importer.findRoles(realmName, clientUUID, names)
+			if err != nil {
+				return err
+			}
+
+			err = importer.adminRequest("POST", []string{realmName, "users", id, "role-mappings", "clients", clientUUID}, nil, roles, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
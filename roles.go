@@ -0,0 +1,151 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// GeneratedRole is a realm or client role
+type GeneratedRole struct {
+	ID   string
+	Name string
+	// Names of the realm roles of a composite role
+	Composites []string
+}
+
+// GeneratedRoleMapping lists the roles of a client granted to a user
+type GeneratedRoleMapping struct {
+	// ID of the GeneratedClient
+	ClientID string
+	Roles    []string
+}
+
+// RoleSpec describes the roles of a realm and how they are granted
+type RoleSpec struct {
+	// Number of realm roles
+	RealmRoles int `yaml:"realmRoles"`
+	// Number of roles of each client
+	ClientRoles int `yaml:"clientRoles"`
+	// Number of composite realm roles, among the realm roles
+	Composites int `yaml:"composites"`
+	// Number of realm roles in each composite role
+	CompositeSize int `yaml:"compositeSize"`
+	// Number of realm roles granted to each user
+	UserRealmRoles int `yaml:"userRealmRoles"`
+	// Number of client roles granted to each user, across all clients
+	UserClientRoles int `yaml:"userClientRoles"`
+}
+
+// Validate checks the role counts
+func (roles RoleSpec) Validate() error {
+	if roles.RealmRoles < 0 || roles.ClientRoles < 0 || roles.Composites < 0 || roles.CompositeSize < 0 || roles.UserRealmRoles < 0 || roles.UserClientRoles < 0 {
+		return fmt.Errorf("The role counts cannot be negative")
+	}
+	if roles.Composites > roles.RealmRoles {
+		return fmt.Errorf("There cannot be more composite roles (%d) than realm roles (%d)", roles.Composites, roles.RealmRoles)
+	}
+	if roles.Composites > 0 && roles.CompositeSize > roles.RealmRoles-roles.Composites {
+		return fmt.Errorf("Composite roles cannot hold more roles (%d) than the non-composite realm roles (%d)", roles.CompositeSize, roles.RealmRoles-roles.Composites)
+	}
+	return nil
+}
+
+// generateRealmRoles generates the realm roles. The first realm roles are
+// the composite ones, made of the other realm roles.
+func generateRealmRoles(seed int64, realmID string, spec RoleSpec) []GeneratedRole {
+	roles := make([]GeneratedRole, spec.RealmRoles)
+	for i := range roles {
+		role := &roles[i]
+		role.ID = fmt.Sprintf("%03d", i)
+		role.Name = "role_" + role.ID
+	}
+
+	simple := roles[spec.Composites:]
+	for i := 0; i < spec.Composites; i++ {
+		role := &roles[i]
+		r := keyedRand(seed, "composite", realmID, role.ID)
+		for _, j := range pickDistinct(r, len(simple), spec.CompositeSize) {
+			role.Composites = append(role.Composites, simple[j].Name)
+		}
+	}
+
+	return roles
+}
+
+// generateClientRoles generates the roles of a client, which are the same
+// for all the clients.
+func generateClientRoles(spec RoleSpec) []GeneratedRole {
+	roles := make([]GeneratedRole, spec.ClientRoles)
+	for i := range roles {
+		role := &roles[i]
+		role.ID = fmt.Sprintf("%03d", i)
+		role.Name = "client_role_" + role.ID
+	}
+	return roles
+}
+
+// assignRoles grants realm and client roles, picked at random, to the user
+func (realm *GeneratedRealm) assignRoles(user *GeneratedUser) {
+	spec := realm.roleSpec
+	r := keyedRand(realm.Seed, "roles", realm.ID, user.ID)
+
+	for _, i := range pickDistinct(r, len(realm.Roles), spec.UserRealmRoles) {
+		user.RealmRoles = append(user.RealmRoles, realm.Roles[i].Name)
+	}
+
+	// Client roles are numbered across all clients
+	clientRoleCount := realm.clientCount * len(realm.clientRoles)
+	for _, i := range pickDistinct(r, clientRoleCount, spec.UserClientRoles) {
+		client := clientID(i / len(realm.clientRoles))
+		role := realm.clientRoles[i%len(realm.clientRoles)]
+
+		last := len(user.ClientRoles) - 1
+		if last < 0 || user.ClientRoles[last].ClientID != client {
+			user.ClientRoles = append(user.ClientRoles, GeneratedRoleMapping{ClientID: client})
+			last++
+		}
+		user.ClientRoles[last].Roles = append(user.ClientRoles[last].Roles, role.Name)
+	}
+}
+
+// pickDistinct picks k distinct integers in [0, n), in increasing order
+func pickDistinct(r *rand.Rand, n, k int) []int {
+	if k >= n {
+		all := make([]int, n)
+		for i := range all {
+			all[i] = i
+		}
+		return all
+	}
+
+	picked := make(map[int]bool, k)
+	result := make([]int, 0, k)
+	for len(result) < k {
+		i := r.Intn(n)
+		if !picked[i] {
+			picked[i] = true
+			result = append(result, i)
+		}
+	}
+	sort.Ints(result)
+	return result
+}
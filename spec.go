@@ -0,0 +1,240 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Statistical distributions of the number of clients or users per realm
+const (
+	UniformDistribution = "uniform"
+	NormalDistribution  = "normal"
+	ZipfDistribution    = "zipf"
+)
+
+// GenerationSpec describes a fleet of realms, as groups of realms sharing
+// the same shape. It is read from a YAML or JSON file.
+type GenerationSpec struct {
+	// Seed used when none is given on the command line
+	Seed   *int64           `yaml:"seed"`
+	Groups []RealmGroupSpec `yaml:"groups"`
+}
+
+// RealmGroupSpec describes a group of similar realms
+type RealmGroupSpec struct {
+	Name   string `yaml:"name"`
+	Realms int    `yaml:"realms"`
+	// Format of the realm IDs, given the index of the realm in the group
+	// (defaults to "<name>_%03d", or "%03d" for an unnamed group)
+	NamePattern string `yaml:"namePattern"`
+	// Template file, relative to the spec file
+	Template string    `yaml:"template"`
+	Clients  CountSpec `yaml:"clients"`
+	Users    CountSpec `yaml:"users"`
+	// Group tree of each realm
+	GroupTree GroupTreeSpec `yaml:"groupTree"`
+	// Roles of each realm
+	Roles RoleSpec `yaml:"roles"`
+
+	template *template.Template
+}
+
+// CountSpec is either a fixed count or a distribution of counts
+type CountSpec struct {
+	Count        int     `yaml:"count"`
+	Distribution string  `yaml:"distribution"`
+	Min          int     `yaml:"min"`
+	Max          int     `yaml:"max"`
+	Mean         float64 `yaml:"mean"`
+	StdDev       float64 `yaml:"stddev"`
+	// Exponent of the Zipf distribution (must be greater than 1)
+	Exponent float64 `yaml:"exponent"`
+}
+
+// UnmarshalYAML accepts a plain number as a fixed count
+func (count *CountSpec) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var fixed int
+	if unmarshal(&fixed) == nil {
+		*count = CountSpec{Count: fixed}
+		return nil
+	}
+
+	type rawCountSpec CountSpec
+	return unmarshal((*rawCountSpec)(count))
+}
+
+// UniformSpec returns the spec of identical realms
+func UniformSpec(realmCount, clientCount, userCount int) GenerationSpec {
+	return GenerationSpec{
+		Groups: []RealmGroupSpec{
+			{Realms: realmCount, Clients: CountSpec{Count: clientCount}, Users: CountSpec{Count: userCount}},
+		},
+	}
+}
+
+// LoadGenerationSpec reads a spec file and the templates it references
+func LoadGenerationSpec(filename string) (GenerationSpec, error) {
+	var spec GenerationSpec
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return spec, err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&spec)
+	if err != nil && err != io.EOF {
+		return spec, fmt.Errorf("Cannot parse the generation spec %s: %s", filename, err)
+	}
+
+	for i := range spec.Groups {
+		group := &spec.Groups[i]
+		if group.Template == "" {
+			continue
+		}
+
+		path := group.Template
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(filename), path)
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return spec, err
+		}
+
+		group.template, err = GetRealmTemplate(string(content))
+		if err != nil {
+			return spec, fmt.Errorf("Cannot parse the template of group '%s': %s", group.Name, err)
+		}
+	}
+
+	return spec, spec.Validate()
+}
+
+// Validate checks the counts and distributions of every group
+func (spec GenerationSpec) Validate() error {
+	if len(spec.Groups) == 0 {
+		return fmt.Errorf("The generation spec has no realm group")
+	}
+
+	for i, group := range spec.Groups {
+		name := group.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+
+		if group.Realms < 0 {
+			return fmt.Errorf("Group %s: the number of realms cannot be negative", name)
+		}
+
+		err := group.Clients.Validate()
+		if err != nil {
+			return fmt.Errorf("Group %s: clients: %s", name, err)
+		}
+
+		err = group.Users.Validate()
+		if err != nil {
+			return fmt.Errorf("Group %s: users: %s", name, err)
+		}
+
+		err = group.GroupTree.Validate()
+		if err != nil {
+			return fmt.Errorf("Group %s: %s", name, err)
+		}
+
+		err = group.Roles.Validate()
+		if err != nil {
+			return fmt.Errorf("Group %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the parameters of the distribution
+func (count CountSpec) Validate() error {
+	switch count.Distribution {
+	case "":
+		if count.Count < 0 {
+			return fmt.Errorf("The count cannot be negative")
+		}
+	case UniformDistribution:
+		if count.Min < 0 || count.Max < count.Min {
+			return fmt.Errorf("The uniform distribution needs 0 <= min <= max")
+		}
+	case NormalDistribution:
+		if count.StdDev < 0 || count.Min < 0 || (count.Max != 0 && count.Max < count.Min) {
+			return fmt.Errorf("The normal distribution needs a positive stddev and 0 <= min <= max")
+		}
+	case ZipfDistribution:
+		if count.Exponent <= 1 {
+			return fmt.Errorf("The Zipf distribution needs an exponent greater than 1")
+		}
+		if count.Min < 0 || count.Max <= count.Min {
+			return fmt.Errorf("The Zipf distribution needs 0 <= min < max")
+		}
+	default:
+		return fmt.Errorf("Unknown distribution '%s' (valid values are '%s', '%s' and '%s')", count.Distribution, UniformDistribution, NormalDistribution, ZipfDistribution)
+	}
+
+	return nil
+}
+
+// Sample draws a count from the distribution
+func (count CountSpec) Sample(r *rand.Rand) int {
+	switch count.Distribution {
+	case UniformDistribution:
+		return count.Min + r.Intn(count.Max-count.Min+1)
+	case NormalDistribution:
+		n := int(math.Round(r.NormFloat64()*count.StdDev + count.Mean))
+		if n < count.Min {
+			n = count.Min
+		}
+		if count.Max != 0 && n > count.Max {
+			n = count.Max
+		}
+		return n
+	case ZipfDistribution:
+		return count.Min + int(rand.NewZipf(r, count.Exponent, 1, uint64(count.Max-count.Min)).Uint64())
+	}
+
+	return count.Count
+}
+
+func (group RealmGroupSpec) realmID(index int) string {
+	pattern := group.NamePattern
+	if pattern == "" && group.Name != "" {
+		pattern = group.Name + "_%03d"
+	} else if pattern == "" {
+		pattern = "%03d"
+	}
+	return fmt.Sprintf(pattern, index)
+}
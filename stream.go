@@ -0,0 +1,223 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"fmt"
+	"text/template"
+	"text/template/parse"
+)
+
+// Number of users generated at once by a goroutine of a streaming realm
+const streamBatchSize = 256
+
+// UserCount returns the number of users of the realm
+func (realm GeneratedRealm) UserCount() int {
+	if realm.streaming {
+		return realm.userCount
+	}
+	return len(realm.Users)
+}
+
+// ClientCount returns the number of clients of the realm
+func (realm GeneratedRealm) ClientCount() int {
+	if realm.streaming {
+		return realm.clientCount
+	}
+	return len(realm.Clients)
+}
+
+// StreamUsers returns the users of the realm, in order, through a channel
+// that templates can range over. The users of streaming realms are
+// generated (and their passwords hashed) on the fly, by several goroutines.
+func (realm GeneratedRealm) StreamUsers() <-chan GeneratedUser {
+	users := make(chan GeneratedUser, streamBatchSize)
+	go func() {
+		defer close(users)
+
+		if !realm.streaming {
+			for _, user := range realm.Users {
+				select {
+				case users <- user:
+				case <-realm.stop:
+					return
+				}
+			}
+			return
+		}
+
+		realm.generateUsers(users)
+	}()
+	return users
+}
+
+// StreamClients returns the clients of the realm, in order, through a
+// channel that templates can range over.
+func (realm GeneratedRealm) StreamClients() <-chan GeneratedClient {
+	clients := make(chan GeneratedClient, streamBatchSize)
+	go func() {
+		defer close(clients)
+
+		for i := 0; i < realm.ClientCount(); i++ {
+			var client GeneratedClient
+			if realm.streaming {
+				client = realm.generateClient(i)
+			} else {
+				client = realm.Clients[i]
+			}
+
+			select {
+			case clients <- client:
+			case <-realm.stop:
+				return
+			}
+		}
+	}()
+	return clients
+}
+
+// generateUsers generates the users by batches, in parallel, and sends them
+// in order. Each batch has its own channel and the channels are queued in
+// order, which bounds the number of users in memory.
+func (realm *GeneratedRealm) generateUsers(users chan<- GeneratedUser) {
+	parallelism := realm.parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	batches := make(chan chan []GeneratedUser, parallelism)
+	go func() {
+		defer close(batches)
+
+		semaphore := make(chan struct{}, parallelism)
+		for start := 0; start < realm.userCount; start += streamBatchSize {
+			end := start + streamBatchSize
+			if end > realm.userCount {
+				end = realm.userCount
+			}
+
+			batch := make(chan []GeneratedUser, 1)
+			select {
+			case batches <- batch:
+			case <-realm.stop:
+				return
+			}
+
+			semaphore <- struct{}{}
+			go func(start, end int) {
+				defer func() { <-semaphore }()
+				batch <- realm.generateUserBatch(start, end)
+			}(start, end)
+		}
+	}()
+
+	for batch := range batches {
+		for _, user := range <-batch {
+			select {
+			case users <- user:
+			case <-realm.stop:
+				return
+			}
+		}
+	}
+}
+
+func (realm *GeneratedRealm) generateUserBatch(start, end int) []GeneratedUser {
+	batch := make([]GeneratedUser, 0, end-start)
+	for i := start; i < end; i++ {
+		user := realm.generateUser(i)
+		if realm.hashing != nil {
+			// The hashing configuration has been validated, this cannot fail
+			credential, _ := HashPassword(user.Password, passwordSalt(realm.Seed, realm.ID, user.ID), *realm.hashing)
+			user.Credential = &credential
+		}
+		batch = append(batch, user)
+	}
+	return batch
+}
+
+// checkStreamingTemplate rejects the templates using .Users or .Clients,
+// which are empty in streaming realms
+func checkStreamingTemplate(tmpl *template.Template) error {
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+
+		node, field := findFields(t.Tree.Root, "Users", "Clients")
+		if node != nil {
+			location, _ := tmpl.ErrorContext(node)
+			return fmt.Errorf("Template %s uses .%s, which is empty when users and clients are streamed (use .Stream%s instead)", location, field, field)
+		}
+	}
+	return nil
+}
+
+// findFields returns the first node accessing one of the fields
+func findFields(node parse.Node, fields ...string) (parse.Node, string) {
+	var children []parse.Node
+	var idents []string
+
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n != nil {
+			children = n.Nodes
+		}
+	case *parse.ActionNode:
+		children = []parse.Node{n.Pipe}
+	case *parse.TemplateNode:
+		children = []parse.Node{n.Pipe}
+	case *parse.IfNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.RangeNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.WithNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.PipeNode:
+		if n != nil {
+			for _, cmd := range n.Cmds {
+				children = append(children, cmd)
+			}
+		}
+	case *parse.CommandNode:
+		children = n.Args
+	case *parse.ChainNode:
+		children = []parse.Node{n.Node}
+		idents = n.Field
+	case *parse.FieldNode:
+		idents = n.Ident
+	case *parse.VariableNode:
+		idents = n.Ident
+	}
+
+	for _, ident := range idents {
+		for _, field := range fields {
+			if ident == field {
+				return node, field
+			}
+		}
+	}
+
+	for _, child := range children {
+		if found, field := findFields(child, fields...); found != nil {
+			return found, field
+		}
+	}
+	return nil, ""
+}
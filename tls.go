@@ -0,0 +1,121 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"gopkg.in/h2non/gentleman.v2"
+)
+
+type TLSOptions struct {
+	// PEM file with the certificate authorities to trust, in addition to the system ones
+	CABundle string
+	// PEM files with the client certificate and key used for mutual TLS
+	ClientCert string
+	ClientKey  string
+	// Minimum TLS version: "1.0", "1.1", "1.2" or "1.3"
+	MinVersion         string
+	InsecureSkipVerify bool
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Transport shared by the token endpoint client and the admin API client
+var httpTransport = newTransport(nil)
+
+func NewTLSConfig(options TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: options.InsecureSkipVerify}
+
+	if options.MinVersion != "" {
+		version, ok := tlsVersions[options.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS version '%s'", options.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if options.CABundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := ioutil.ReadFile(options.CABundle)
+		if err != nil {
+			return nil, err
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate found in CA bundle %s", options.CABundle)
+		}
+		config.RootCAs = pool
+	}
+
+	if options.ClientCert != "" || options.ClientKey != "" {
+		if options.ClientCert == "" || options.ClientKey == "" {
+			return nil, fmt.Errorf("Both a client certificate and a client key are required for mutual TLS")
+		}
+
+		cert, err := tls.LoadX509KeyPair(options.ClientCert, options.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// SetTLSConfig applies the TLS configuration to all the HTTP clients created
+// afterwards, for both the admin API and the token endpoint.
+func SetTLSConfig(config *tls.Config) {
+	httpTransport = newTransport(config)
+
+	// The Keycloak client relies on gentleman, whose HTTP clients are built
+	// from its default transport.
+	gentleman.DefaultTransport = httpTransport
+}
+
+// NewHTTPClient returns an HTTP client honoring the TLS configuration.
+func NewHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: httpTransport}
+}
+
+func newTransport(config *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:     config,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 100,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
@@ -0,0 +1,235 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Client used to log in with the password grant when none is configured
+const defaultAdminClientID = "admin-cli"
+
+// Validity period of the JWT client assertions
+const clientAssertionLifespan = time.Minute
+
+// OIDCToken is a token set returned by the Keycloak token endpoint.
+type OIDCToken struct {
+	AccessToken      string
+	RefreshToken     string
+	IssuedAt         time.Time
+	ExpiresAt        time.Time
+	RefreshExpiresAt time.Time
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Lifespan returns the validity period of the access token, or zero when
+// the token endpoint did not tell.
+func (t OIDCToken) Lifespan() time.Duration {
+	if t.ExpiresAt.IsZero() {
+		return 0
+	}
+	return t.ExpiresAt.Sub(t.IssuedAt)
+}
+
+// CanRefresh tells whether the refresh token can still be used.
+func (t OIDCToken) CanRefresh() bool {
+	if t.RefreshToken == "" {
+		return false
+	}
+
+	// A refresh_expires_in of zero means the refresh token does not expire
+	return t.RefreshExpiresAt.IsZero() || time.Now().Before(t.RefreshExpiresAt)
+}
+
+func (importer *KeycloakImporter) requestToken(form url.Values) (OIDCToken, error) {
+	var token OIDCToken
+
+	issuedAt := time.Now()
+	resp, err := importer.httpClient.PostForm(importer.tokenURL, form)
+	if err != nil {
+		return token, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return token, err
+	}
+
+	var response tokenResponse
+	err = json.Unmarshal(body, &response)
+	if resp.StatusCode != http.StatusOK {
+		message := strings.TrimSpace(string(body))
+		if err == nil && response.Error != "" {
+			message = response.Error
+			if response.ErrorDescription != "" {
+				message += ": " + response.ErrorDescription
+			}
+		}
+		return token, &ImportError{StatusCode: resp.StatusCode, Message: message}
+	}
+	if err != nil {
+		return token, err
+	}
+
+	if response.AccessToken == "" {
+		return token, &ImportError{StatusCode: resp.StatusCode, Message: "No access token in the token endpoint response"}
+	}
+
+	token.AccessToken = response.AccessToken
+	token.RefreshToken = response.RefreshToken
+	token.IssuedAt = issuedAt
+	if response.ExpiresIn > 0 {
+		token.ExpiresAt = issuedAt.Add(time.Duration(response.ExpiresIn) * time.Second)
+	}
+	if response.RefreshExpiresIn > 0 {
+		token.RefreshExpiresAt = issuedAt.Add(time.Duration(response.RefreshExpiresIn) * time.Second)
+	}
+
+	return token, nil
+}
+
+func (importer *KeycloakImporter) setToken(token OIDCToken) {
+	importer.OIDCToken = token
+	importer.Token = token.AccessToken
+}
+
+// authenticateClient adds the client authentication parameters matching
+// the configured authentication method to a token request.
+func (importer *KeycloakImporter) authenticateClient(form url.Values) error {
+	credentials := importer.Credentials
+	clientID := credentials.ClientID
+	if clientID == "" {
+		clientID = defaultAdminClientID
+	}
+	form.Set("client_id", clientID)
+
+	switch {
+	case credentials.AuthMethod == ClientJWTAuth:
+		assertion, err := importer.signClientAssertion(clientID)
+		if err != nil {
+			return err
+		}
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", assertion)
+	case credentials.ClientSecret != "":
+		form.Set("client_secret", credentials.ClientSecret)
+	}
+
+	return nil
+}
+
+// signClientAssertion builds a JWT client assertion (RFC 7523) signed with
+// the client key, as expected by the Keycloak "Signed JWT" client
+// authenticator.
+func (importer *KeycloakImporter) signClientAssertion(clientID string) (string, error) {
+	key := importer.Credentials.ClientKey
+	if key == nil {
+		return "", fmt.Errorf("No client key provided to sign the client assertion")
+	}
+
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if importer.Credentials.ClientKeyID != "" {
+		header["kid"] = importer.Credentials.ClientKeyID
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": clientID,
+		"sub": clientID,
+		"aud": importer.tokenURL,
+		"jti": uuid.New().String(),
+		"iat": now.Unix(),
+		"exp": now.Add(clientAssertionLifespan).Unix(),
+	}
+
+	encodedHeader, err := encodeJWTPart(header)
+	if err != nil {
+		return "", err
+	}
+	encodedClaims, err := encodeJWTPart(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encodedHeader + "." + encodedClaims
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func encodeJWTPart(part interface{}) (string, error) {
+	b, err := json.Marshal(part)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ParseClientKey decodes a PEM encoded RSA private key (PKCS#1 or PKCS#8)
+// used to sign the JWT client assertions.
+func ParseClientKey(content []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in the client key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("The client key is not an RSA private key")
+	}
+
+	return rsaKey, nil
+}
@@ -0,0 +1,411 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"text/template"
+	"text/template/parse"
+
+	keycloak "github.com/nmasse-itix/keycloak-client"
+)
+
+// Name of the function recording the output offset of the template nodes
+const markFunction = "kciMark"
+
+// unknownFieldError matches the error returned by DisallowUnknownFields
+var unknownFieldError = regexp.MustCompile(`^json: unknown field "(.*)"$`)
+
+// TemplateError is an invalid realm rendered by a template
+type TemplateError struct {
+	RealmID string
+	// Position in the template (name:line:column), if known
+	Location string
+	// Position in the rendered realm (the column starts at zero)
+	Line, Column int
+	Err          error
+}
+
+func (e *TemplateError) Error() string {
+	if e.Location != "" {
+		return fmt.Sprintf("Invalid realm %s: %s (template %s, output %d:%d)", e.RealmID, e.Err, e.Location, e.Line, e.Column)
+	}
+	return fmt.Sprintf("Invalid realm %s: %s (output %d:%d)", e.RealmID, e.Err, e.Line, e.Column)
+}
+
+// Number of recent bytes kept by the recordingReader
+const recordedBytes = 1 << 20
+
+// recordingReader keeps the last bytes read, to find out where the values
+// decoded by a json.Decoder start.
+type recordingReader struct {
+	r      io.Reader
+	buffer []byte
+	total  int
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	for _, b := range p[:n] {
+		rr.buffer[rr.total%len(rr.buffer)] = b
+		rr.total++
+	}
+	return n, err
+}
+
+// errorOffset returns the offset of a syntax error found by a decoder after
+// the given offset (the end of the last value decoded successfully). The
+// offsets reported by the decoder vary across Go versions: the recorded
+// bytes are decoded again, from the start of the faulty value.
+func (rr *recordingReader) errorOffset(offset int, err error) (int, error) {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return rr.total, fmt.Errorf("unexpected end of JSON input")
+	}
+
+	// Skip the blanks and the separator before the value
+	start := offset
+	for i := offset; i < rr.total; i++ {
+		if i < rr.total-len(rr.buffer) {
+			// Not recorded anymore
+			return offset, err
+		}
+		c := rr.buffer[i%len(rr.buffer)]
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			continue
+		}
+		start = i
+		if c == ':' || c == ',' {
+			start = i + 1
+		}
+		break
+	}
+
+	recorded := make([]byte, 0, rr.total-start)
+	for i := start; i < rr.total; i++ {
+		recorded = append(recorded, rr.buffer[i%len(rr.buffer)])
+	}
+
+	var raw json.RawMessage
+	var syntaxError *json.SyntaxError
+	if errors.As(json.NewDecoder(bytes.NewReader(recorded)).Decode(&raw), &syntaxError) {
+		return start + int(syntaxError.Offset) - 1, err
+	}
+
+	// The value is valid, what comes before is not (a missing separator)
+	for i, c := range recorded {
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return start + i, err
+		}
+	}
+	return start, err
+}
+
+// validateRealm checks, as it is rendered, that the realm is well-formed
+// JSON that decodes into a RealmRepresentation, without unknown fields.
+// Users and clients are decoded one at a time, so that the memory used does
+// not depend on their number. On error, it returns the offset of the faulty
+// part of the rendered realm.
+func validateRealm(r io.Reader) (int, error) {
+	rr := &recordingReader{r: r, buffer: make([]byte, recordedBytes)}
+	decoder := json.NewDecoder(rr)
+
+	// Decodes a value and validates it against the type of target. The
+	// errors of the prefix are reported at keyStart.
+	decodeValue := func(target interface{}, prefix string, keyStart int) (int, error) {
+		base := int(decoder.InputOffset())
+
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if err != nil {
+			return rr.errorOffset(base, err)
+		}
+
+		start := int(decoder.InputOffset()) - len(raw)
+		content := append([]byte(prefix), raw...)
+		if prefix != "" {
+			content = append(content, '}')
+		}
+
+		strict := json.NewDecoder(bytes.NewReader(content))
+		strict.DisallowUnknownFields()
+		err = strict.Decode(target)
+		if err != nil {
+			offset, err := jsonErrorOffset(err, 0, len(content))
+			if m := unknownFieldError.FindStringSubmatch(err.Error()); m != nil {
+				// The decoder does not tell where the unknown field is:
+				// point to its first occurrence
+				key := regexp.MustCompile(regexp.QuoteMeta(strconv.Quote(m[1])) + `\s*:`)
+				if loc := key.FindIndex(content); loc != nil {
+					offset = loc[0]
+				}
+			}
+			if offset < len(prefix) {
+				return keyStart, err
+			}
+			return start + offset - len(prefix), err
+		}
+		return 0, nil
+	}
+
+	token, err := decoder.Token()
+	if err != nil {
+		return rr.errorOffset(0, err)
+	}
+	if token != json.Delim('{') {
+		return 0, fmt.Errorf("expected a JSON object")
+	}
+
+	for decoder.More() {
+		base := int(decoder.InputOffset())
+		token, err := decoder.Token()
+		if err != nil {
+			return rr.errorOffset(base, err)
+		}
+		key, _ := token.(string)
+		prefix := "{" + strconv.Quote(key) + ":"
+		keyStart := int(decoder.InputOffset()) - len(strconv.Quote(key))
+
+		if key != "users" && key != "clients" {
+			offset, err := decodeValue(&keycloak.RealmRepresentation{}, prefix, keyStart)
+			if err != nil {
+				return offset, err
+			}
+			continue
+		}
+
+		// Users and clients are lists
+		base = int(decoder.InputOffset())
+		token, err = decoder.Token()
+		if err != nil {
+			return rr.errorOffset(base, err)
+		}
+		if token == nil {
+			continue
+		}
+		if token != json.Delim('[') {
+			return rr.errorOffset(base, fmt.Errorf("'%s' is not a list", key))
+		}
+
+		for decoder.More() {
+			var target interface{} = &keycloak.UserRepresentation{}
+			if key == "clients" {
+				target = &keycloak.ClientRepresentation{}
+			}
+
+			offset, err := decodeValue(target, "", 0)
+			if err != nil {
+				return offset, err
+			}
+		}
+
+		base = int(decoder.InputOffset())
+		_, err = decoder.Token()
+		if err != nil {
+			return rr.errorOffset(base, err)
+		}
+	}
+
+	base := int(decoder.InputOffset())
+	_, err = decoder.Token()
+	if err != nil {
+		return rr.errorOffset(base, err)
+	}
+
+	base = int(decoder.InputOffset())
+	_, err = decoder.Token()
+	if err != io.EOF {
+		return rr.errorOffset(base, fmt.Errorf("unexpected data after the realm"))
+	}
+
+	return 0, nil
+}
+
+// jsonErrorOffset returns the offset of a decoding error, relative to the
+// start of the decoded value.
+func jsonErrorOffset(err error, start, end int) (int, error) {
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxError):
+		return start + int(syntaxError.Offset) - 1, err
+	case errors.As(err, &typeError):
+		return start + int(typeError.Offset) - 1, err
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return end, fmt.Errorf("unexpected end of JSON input")
+	}
+	return start, err
+}
+
+// newTemplateError locates the error in the rendered realm and in the
+// template.
+func newTemplateError(realm GeneratedRealm, tmpl *template.Template, offset int, err error) error {
+	if offset < 0 {
+		offset = 0
+	}
+
+	e := &TemplateError{RealmID: realm.ID, Err: err}
+	e.Location, e.Line, e.Column = locateInTemplate(realm, tmpl, offset)
+	return e
+}
+
+// offsetCounter counts the bytes rendered by a template, and the lines
+// before the offset of an error.
+type offsetCounter struct {
+	count  int
+	target int
+	// Position of the target
+	line, column int
+}
+
+func (counter *offsetCounter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if counter.count < counter.target {
+			counter.column++
+			if b == '\n' {
+				counter.line++
+				counter.column = 0
+			}
+		}
+		counter.count++
+	}
+	return len(p), nil
+}
+
+// errLocated stops the rendering of locateInTemplate
+var errLocated = errors.New("located")
+
+// locateInTemplate finds the template position (name:line:column) that
+// rendered the given offset, as well as the line and column in the rendered
+// realm. The template is rendered again with a mark before each node, that
+// records the output offset at which the node starts.
+func locateInTemplate(realm GeneratedRealm, tmpl *template.Template, offset int) (string, int, int) {
+	var counter offsetCounter
+	counter.target = offset
+	counter.line = 1
+
+	instrumented, err := tmpl.Clone()
+	if err != nil {
+		return "", 0, 0
+	}
+
+	var nodes []parse.Node
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		tree := t.Tree.Copy()
+		instrumentList(tree, tree.Root, &nodes)
+		_, err := instrumented.AddParseTree(t.Name(), tree)
+		if err != nil {
+			return "", 0, 0
+		}
+	}
+
+	// Only the last node starting before the offset is kept. The rendering
+	// stops at the first node starting after the offset, so that the rest
+	// of the realm (such as millions of streamed users) is not generated
+	// again.
+	var found parse.Node
+	var foundOffset int
+	instrumented.Funcs(templateFunctions(realm.Seed, realm.ID))
+	instrumented.Funcs(template.FuncMap{
+		markFunction: func(i int) (string, error) {
+			if counter.count > offset {
+				return "", errLocated
+			}
+			found, foundOffset = nodes[i], counter.count
+			return "", nil
+		},
+	})
+
+	// The output is the same as the first time, errors are not relevant
+	stop := make(chan struct{})
+	realm.stop = stop
+	instrumented.Execute(&counter, realm)
+	close(stop)
+
+	if found == nil {
+		return "", counter.line, counter.column
+	}
+
+	// Inside a text node, the position is exact
+	pos := found.Position()
+	if text, ok := found.(*parse.TextNode); ok && offset-foundOffset < len(text.Text) {
+		pos += parse.Pos(offset - foundOffset)
+	}
+
+	location, _ := tmpl.ErrorContext(&parse.TextNode{NodeType: parse.NodeText, Pos: pos})
+	return location, counter.line, counter.column
+}
+
+// instrumentList inserts a mark before each node of the list, recursively
+func instrumentList(tree *parse.Tree, list *parse.ListNode, nodes *[]parse.Node) {
+	if list == nil {
+		return
+	}
+
+	var instrumented []parse.Node
+	for _, node := range list.Nodes {
+		switch n := node.(type) {
+		case *parse.IfNode:
+			instrumentList(tree, n.List, nodes)
+			instrumentList(tree, n.ElseList, nodes)
+		case *parse.RangeNode:
+			instrumentList(tree, n.List, nodes)
+			instrumentList(tree, n.ElseList, nodes)
+		case *parse.WithNode:
+			instrumentList(tree, n.List, nodes)
+			instrumentList(tree, n.ElseList, nodes)
+		}
+
+		// Empty text nodes (between trim markers) render nothing
+		if text, ok := node.(*parse.TextNode); ok && len(text.Text) == 0 {
+			instrumented = append(instrumented, node)
+			continue
+		}
+
+		*nodes = append(*nodes, node)
+		instrumented = append(instrumented, markNode(tree, node.Position(), len(*nodes)-1), node)
+	}
+	list.Nodes = instrumented
+}
+
+// markNode returns the {{ kciMark i }} action
+func markNode(tree *parse.Tree, pos parse.Pos, i int) parse.Node {
+	index := strconv.Itoa(i)
+	cmd := &parse.CommandNode{
+		NodeType: parse.NodeCommand,
+		Pos:      pos,
+		Args: []parse.Node{
+			parse.NewIdentifier(markFunction).SetTree(tree).SetPos(pos),
+			&parse.NumberNode{NodeType: parse.NodeNumber, Pos: pos, IsInt: true, Int64: int64(i), Text: index},
+		},
+	}
+	return &parse.ActionNode{
+		NodeType: parse.NodeAction,
+		Pos:      pos,
+		Pipe:     &parse.PipeNode{NodeType: parse.NodePipe, Pos: pos, Cmds: []*parse.CommandNode{cmd}},
+	}
+}
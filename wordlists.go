@@ -0,0 +1,80 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+// Word lists used to generate user profiles
+
+var firstNames = []string{
+	"Aaliyah", "Adam", "Adèle", "Ahmed", "Aiko", "Alejandro", "Alice", "Amara",
+	"Amélie", "Ana", "Andrea", "Anna", "Arjun", "Ben", "Bruno", "Camille",
+	"Carlos", "Charlotte", "Chen", "Chloé", "Daniel", "David", "Diego", "Elena",
+	"Elif", "Emily", "Emma", "Ethan", "Fatima", "Felix", "Francesca", "Gabriel",
+	"Giulia", "Hana", "Hannah", "Hiroshi", "Hugo", "Ingrid", "Isabella", "Ivan",
+	"Jack", "James", "Javier", "Jin", "João", "Julia", "Kai", "Karim",
+	"Laura", "Léa", "Leon", "Liam", "Lina", "Louis", "Lucas", "Lucía",
+	"Luis", "Maria", "Mariam", "Mateo", "Mia", "Mohammed", "Nadia", "Noah",
+	"Nora", "Olivia", "Omar", "Paul", "Pedro", "Priya", "Rafael", "Raphaël",
+	"Rosa", "Sakura", "Samuel", "Sara", "Sofia", "Sophie", "Stefan", "Thomas",
+	"Valentina", "Victor", "Wei", "William", "Yara", "Yusuf", "Zoé", "Zoran",
+}
+
+var lastNames = []string{
+	"Abe", "Ahmed", "Alvarez", "Andersen", "Bauer", "Bernard", "Bianchi", "Brown",
+	"Chen", "Costa", "Da Silva", "Dubois", "Durand", "Fernández", "Ferrari", "Fischer",
+	"García", "Gonzalez", "Green", "Hansen", "Hernández", "Hoffmann", "Ito", "Ivanov",
+	"Jensen", "Johnson", "Kaya", "Kim", "Kowalski", "Kumar", "Lambert", "Laurent",
+	"Lee", "Lefebvre", "Li", "López", "Martin", "Martínez", "Meyer", "Moreau",
+	"Müller", "Nakamura", "Nguyen", "Nielsen", "Novak", "O'Brien", "Okafor", "Olsen",
+	"Patel", "Pereira", "Petit", "Popescu", "Ricci", "Robert", "Rodríguez", "Romano",
+	"Rossi", "Sánchez", "Santos", "Schmidt", "Schneider", "Silva", "Singh", "Smith",
+	"Suzuki", "Tanaka", "Taylor", "Thomas", "Van Dijk", "Wagner", "Wang", "Weber",
+	"Williams", "Wilson", "Wójcik", "Yamamoto", "Yilmaz", "Zhang", "Zimmermann", "Zhou",
+}
+
+var emailDomains = []string{
+	"example.test", "mail.test", "corp.test", "acme.test", "globex.test", "initech.test",
+}
+
+// Locales, with the matching phone country code
+var locales = []struct {
+	Locale      string
+	CountryCode string
+}{
+	{"en", "1"},
+	{"en-GB", "44"},
+	{"fr", "33"},
+	{"de", "49"},
+	{"es", "34"},
+	{"it", "39"},
+	{"pt-BR", "55"},
+	{"ja", "81"},
+	{"zh-CN", "86"},
+	{"tr", "90"},
+}
+
+var departments = []string{
+	"Engineering", "Finance", "Human Resources", "Legal", "Marketing",
+	"Operations", "Product", "Sales", "Support", "Research",
+}
+
+var cities = []string{
+	"Amsterdam", "Berlin", "Boston", "Lisbon", "London", "Lyon", "Madrid", "Milan",
+	"Montréal", "Osaka", "Paris", "São Paulo", "Seoul", "Shanghai", "Singapore", "Sydney",
+	"Tokyo", "Toronto", "Warsaw", "Zürich",
+}
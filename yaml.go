@@ -0,0 +1,344 @@
+/*
+ * This file is part of the keycloak-import-realm distribution
+ * (https://github.com/nmasse-itix/keycloak-import-realm).
+ * Copyright (c) 2021 Nicolas Massé <nicolas.masse@itix.fr>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package kcimport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Extensions of YAML realm files
+var yamlExtensions = []string{".yaml", ".yml"}
+
+// YAMLError is an error of a YAML realm file
+type YAMLError struct {
+	// Position of the faulty node (the column starts at one)
+	Line, Column int
+	Err          error
+}
+
+func (e *YAMLError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Err)
+}
+
+// yamlSpan is the part of the JSON document converted from a YAML node
+type yamlSpan struct {
+	start, end   int
+	line, column int
+}
+
+// yamlDocument is a YAML document converted to JSON
+type yamlDocument struct {
+	json bytes.Buffer
+	// Spans of the nodes, parents first
+	spans []yamlSpan
+}
+
+// yamlToJSON converts a YAML document to JSON, keeping track of the YAML
+// node each part of the JSON document comes from.
+func yamlToJSON(content []byte) (*yamlDocument, error) {
+	var root yaml.Node
+	err := yaml.Unmarshal(content, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &yamlDocument{}
+	if root.Kind == 0 {
+		// Empty document
+		doc.json.WriteString("null")
+		return doc, nil
+	}
+
+	err = doc.convert(&root)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (doc *yamlDocument) convert(node *yaml.Node) error {
+	span := len(doc.spans)
+	doc.spans = append(doc.spans, yamlSpan{start: doc.json.Len(), line: node.Line, column: node.Column})
+	defer func() {
+		doc.spans[span].end = doc.json.Len()
+	}()
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		return doc.convert(node.Content[0])
+	case yaml.AliasNode:
+		return doc.convert(node.Alias)
+	case yaml.SequenceNode:
+		doc.json.WriteString("[")
+		for i, item := range node.Content {
+			if i > 0 {
+				doc.json.WriteString(",")
+			}
+			err := doc.convert(item)
+			if err != nil {
+				return err
+			}
+		}
+		doc.json.WriteString("]")
+		return nil
+	case yaml.MappingNode:
+		doc.json.WriteString("{")
+		_, err := doc.convertPairs(node, true)
+		doc.json.WriteString("}")
+		return err
+	}
+
+	return doc.convertScalar(node)
+}
+
+// convertPairs converts the pairs of a mapping. The pairs of merged
+// mappings (<<) come first, so that the other pairs take precedence. It
+// returns whether the JSON object is still empty.
+func (doc *yamlDocument) convertPairs(node *yaml.Node, first bool) (bool, error) {
+	for _, merging := range []bool{true, false} {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if (key.Kind == yaml.ScalarNode && key.Tag == "!!merge") != merging {
+				continue
+			}
+
+			var err error
+			if merging {
+				first, err = doc.convertMerge(value, first)
+				if err != nil {
+					return first, err
+				}
+				continue
+			}
+
+			if key.Kind != yaml.ScalarNode {
+				return first, &YAMLError{key.Line, key.Column, errors.New("keys must be strings")}
+			}
+			if !first {
+				doc.json.WriteString(",")
+			}
+			first = false
+
+			doc.spans = append(doc.spans, yamlSpan{start: doc.json.Len(), line: key.Line, column: key.Column})
+			name, _ := json.Marshal(key.Value)
+			doc.json.Write(name)
+			doc.spans[len(doc.spans)-1].end = doc.json.Len()
+			doc.json.WriteString(":")
+
+			err = doc.convert(value)
+			if err != nil {
+				return first, err
+			}
+		}
+	}
+	return first, nil
+}
+
+// convertMerge converts the pairs of the mappings merged by <<
+func (doc *yamlDocument) convertMerge(node *yaml.Node, first bool) (bool, error) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		return doc.convertPairs(node, first)
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			var err error
+			first, err = doc.convertMerge(item, first)
+			if err != nil {
+				return first, err
+			}
+		}
+		return first, nil
+	}
+	return first, &YAMLError{node.Line, node.Column, errors.New("only mappings can be merged")}
+}
+
+func (doc *yamlDocument) convertScalar(node *yaml.Node) error {
+	var value interface{}
+	switch node.ShortTag() {
+	case "!!null":
+		value = nil
+	case "!!bool", "!!int", "!!float":
+		err := node.Decode(&value)
+		if err != nil {
+			return &YAMLError{node.Line, node.Column, err}
+		}
+		if f, ok := value.(float64); ok && (math.IsInf(f, 0) || math.IsNaN(f)) {
+			return &YAMLError{node.Line, node.Column, fmt.Errorf("%s cannot be represented in JSON", node.Value)}
+		}
+	default:
+		// Strings, timestamps and binary data are kept as they are written
+		value = node.Value
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return &YAMLError{node.Line, node.Column, err}
+	}
+	doc.json.Write(b)
+	return nil
+}
+
+// locate returns the innermost YAML node the JSON offset comes from
+func (doc *yamlDocument) locate(offset int) (int, int) {
+	var line, column int
+	for _, span := range doc.spans {
+		if offset >= span.start && offset < span.end {
+			line, column = span.line, span.column
+		}
+	}
+	return line, column
+}
+
+// decode decodes the JSON document into v, the errors pointing to the YAML
+// document.
+func (doc *yamlDocument) decode(v interface{}) error {
+	err := json.Unmarshal(doc.json.Bytes(), v)
+	if err == nil {
+		return nil
+	}
+
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &typeError) {
+		// The offset follows the faulty value
+		line, column := doc.locate(int(typeError.Offset) - 1)
+		return &YAMLError{line, column, err}
+	}
+	return err
+}
+
+// isYAML tells whether a realm file is written in YAML: YAML files have the
+// .yaml or .yml extension, or do not start with a JSON object.
+func isYAML(name string, r *bufio.Reader) bool {
+	extension := path.Ext(strings.TrimSuffix(name, GzipExtension))
+	for _, e := range yamlExtensions {
+		if extension == e {
+			return true
+		}
+	}
+	if extension == ".json" {
+		return false
+	}
+
+	for i := 1; ; i++ {
+		b, err := r.Peek(i)
+		if err != nil {
+			return false
+		}
+		switch b[i-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b[i-1] != '{'
+	}
+}
+
+// DecodeRealmFile decodes a realm file (or a <realm>-users-<n>.json file),
+// written in JSON or in YAML. YAML files use the field names of JSON files.
+func DecodeRealmFile(input RealmInput, v interface{}) error {
+	r := bufio.NewReader(input)
+	if !isYAML(input.Name, r) {
+		err := json.NewDecoder(r).Decode(v)
+		if err != nil {
+			return fmt.Errorf("Cannot decode %s: %s", input.Name, err)
+		}
+		return nil
+	}
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("Cannot read %s: %s", input.Name, err)
+	}
+
+	doc, err := yamlToJSON(content)
+	if err == nil {
+		err = doc.decode(v)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot decode %s: %s", input.Name, err)
+	}
+	return nil
+}
+
+// validateYAMLRealm validates a realm rendered in YAML, as validateRealm
+// does. On error, it returns the offset of the faulty YAML node.
+func validateYAMLRealm(r io.Reader) (int, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	doc, err := yamlToJSON(content)
+	if err != nil {
+		var yamlError *YAMLError
+		if errors.As(err, &yamlError) {
+			return lineOffset(content, yamlError.Line, yamlError.Column), err
+		}
+		return yamlErrorOffset(content, err), err
+	}
+
+	offset, err := validateRealm(bytes.NewReader(doc.json.Bytes()))
+	if err != nil {
+		line, column := doc.locate(offset)
+		return lineOffset(content, line, column), err
+	}
+	return 0, nil
+}
+
+// lineOffset returns the offset of a line and column (starting at one)
+func lineOffset(content []byte, line, column int) int {
+	offset := 0
+	for l := 1; l < line; l++ {
+		i := bytes.IndexByte(content[offset:], '\n')
+		if i < 0 {
+			return len(content)
+		}
+		offset += i + 1
+	}
+	if column > 0 {
+		offset += column - 1
+	}
+	if offset > len(content) {
+		offset = len(content)
+	}
+	return offset
+}
+
+// yamlErrorOffset returns the offset of the line of a YAML parse error
+func yamlErrorOffset(content []byte, err error) int {
+	var line int
+	if _, scanErr := fmt.Sscanf(err.Error(), "yaml: line %d:", &line); scanErr != nil {
+		return 0
+	}
+	return lineOffset(content, line, 1)
+}